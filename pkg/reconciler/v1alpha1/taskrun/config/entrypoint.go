@@ -17,6 +17,9 @@ limitations under the License.
 package config
 
 import (
+	"fmt"
+	"strings"
+
 	corev1 "k8s.io/api/core/v1"
 )
 
@@ -29,6 +32,22 @@ const (
 	// entrypoint image.
 	ImageKey = "image"
 
+	// RegistryMirrorsKey is the name of the configuration entry that specifies
+	// the registry mirrors through which image configs are fetched when
+	// looking up the entrypoint of step images, as whitespace separated
+	// registry=mirror pairs.
+	RegistryMirrorsKey = "registry-mirrors"
+
+	// DockerConfigKey is the name of the configuration entry that specifies
+	// the path of a docker config file with registry credentials used when
+	// looking up the entrypoint of step images.
+	DockerConfigKey = "docker-config"
+
+	// UserAgentKey is the name of the configuration entry that specifies the
+	// User-Agent header sent to registries when looking up the entrypoint of
+	// step images.
+	UserAgentKey = "user-agent"
+
 	// DefaultEntrypointImage is the default value of the ImageKey.
 	DefaultEntrypointImage = "gcr.io/k8s-prow/entrypoint@sha256:7c7cd8906ce4982ffee326218e9fc75da2d4896d53cabc9833b9cc8d2d6b2b8f"
 )
@@ -39,6 +58,22 @@ type Entrypoint struct {
 	// Image specifies the entrypoint image which will used by taskrun
 	// to capture logs.
 	Image string
+
+	// RegistryMirrors maps registry hosts to the host, optionally with a
+	// port, of the mirror to fetch their step images from when looking up
+	// their entrypoint. Images not found on the mirror are fetched from their
+	// own registry, and images of other registries aren't mirrored.
+	RegistryMirrors map[string]string
+
+	// DockerConfig specifies the path of a docker config file whose
+	// credentials are used for registries the controller has no other
+	// credentials for when looking up the entrypoint of step images.
+	DockerConfig string
+
+	// UserAgent specifies the User-Agent header sent to registries when
+	// looking up the entrypoint of step images, so that registry operators
+	// can recognize the controller. The default one is used when empty.
+	UserAgent string
 }
 
 // NewEntrypointConfigFromConfigMap creates a Entrypoint from the supplied ConfigMap
@@ -55,5 +90,17 @@ func NewEntrypointConfigFromConfigMap(configMap *corev1.ConfigMap) (*Entrypoint,
 	} else {
 		c.Image = image
 	}
+	if mirrors, ok := configMap.Data[RegistryMirrorsKey]; ok {
+		c.RegistryMirrors = map[string]string{}
+		for _, pair := range strings.Fields(mirrors) {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return nil, fmt.Errorf("invalid %s entry %q, expected registry=mirror", RegistryMirrorsKey, pair)
+			}
+			c.RegistryMirrors[parts[0]] = parts[1]
+		}
+	}
+	c.DockerConfig = configMap.Data[DockerConfigKey]
+	c.UserAgent = configMap.Data[UserAgentKey]
 	return c, nil
 }
@@ -47,6 +47,66 @@ func TestEntrypointConfiguration(t *testing.T) {
 				ImageKey: testImage,
 			},
 		}}, {
+		name: "entrypoint with registry mirrors",
+		wantEntrypoint: &Entrypoint{
+			Image: testImage,
+			RegistryMirrors: map[string]string{
+				"docker.io": "mirror.registry.svc:5000",
+				"gcr.io":    "gcr-mirror.registry.svc",
+			},
+		},
+		config: &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: system.Namespace,
+				Name:      EntrypointConfigName,
+			},
+			Data: map[string]string{
+				ImageKey:           testImage,
+				RegistryMirrorsKey: "docker.io=mirror.registry.svc:5000\n  gcr.io=gcr-mirror.registry.svc\n",
+			},
+		}}, {
+		name:    "entrypoint with invalid registry mirror",
+		wantErr: true,
+		config: &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: system.Namespace,
+				Name:      EntrypointConfigName,
+			},
+			Data: map[string]string{
+				ImageKey:           testImage,
+				RegistryMirrorsKey: "mirror.registry.svc:5000",
+			},
+		}}, {
+		name: "entrypoint with docker config",
+		wantEntrypoint: &Entrypoint{
+			Image:        testImage,
+			DockerConfig: "/var/secret/docker/config.json",
+		},
+		config: &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: system.Namespace,
+				Name:      EntrypointConfigName,
+			},
+			Data: map[string]string{
+				ImageKey:        testImage,
+				DockerConfigKey: "/var/secret/docker/config.json",
+			},
+		}}, {
+		name: "entrypoint with user agent",
+		wantEntrypoint: &Entrypoint{
+			Image:     testImage,
+			UserAgent: "my-pipelines/1.0",
+		},
+		config: &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: system.Namespace,
+				Name:      EntrypointConfigName,
+			},
+			Data: map[string]string{
+				ImageKey:     testImage,
+				UserAgentKey: "my-pipelines/1.0",
+			},
+		}}, {
 		name: "entrypoint with no image",
 		wantEntrypoint: &Entrypoint{
 			Image: DefaultEntrypointImage,
@@ -72,7 +132,13 @@ func TestEntrypointConfiguration(t *testing.T) {
 	}
 
 	for _, tt := range configTests {
-		actualEntrypoint, _ := NewEntrypointConfigFromConfigMap(tt.config)
+		actualEntrypoint, err := NewEntrypointConfigFromConfigMap(tt.config)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("Test: %q; NewEntrypointConfigFromConfigMap() error = %v, wantErr %t", tt.name, err, tt.wantErr)
+		}
+		if tt.wantErr {
+			continue
+		}
 
 		if diff := cmp.Diff(actualEntrypoint, tt.wantEntrypoint); diff != "" {
 			t.Fatalf("Test: %q; want %v, but got %v", tt.name, tt.wantEntrypoint, actualEntrypoint)
@@ -20,12 +20,18 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	lru "github.com/hashicorp/golang-lru"
+	"go.uber.org/zap"
 	corev1 "k8s.io/api/core/v1"
 
 	"github.com/knative/build-pipeline/pkg/reconciler/v1alpha1/taskrun/config"
@@ -44,6 +50,25 @@ const (
 	MarkerFile        = "/tools/marker-file.txt"
 	digestSeparator   = "@"
 	cacheSize         = 1024
+	negativeCacheSize = 128
+	// warmConcurrency is the maximum number of images Warm looks up at once.
+	warmConcurrency = 8
+	// DefaultNegativeTTL is how long images that couldn't be found in the
+	// registry are remembered as missing by default.
+	DefaultNegativeTTL = 30 * time.Second
+	// DefaultTagTTL is how long the digests of images referenced by tag are
+	// cached by default.
+	DefaultTagTTL = 5 * time.Minute
+	// Keys of the values kept in the Store of a Cache are prefixed with the
+	// kind of value, so that the digest and the entrypoint of an image pinned
+	// by digest don't overwrite each other when caches share a Store.
+	digestKeyPrefix     = "digest/"
+	entrypointKeyPrefix = "entrypoint/"
+	// DefaultUserAgent is the User-Agent header sent to registries by default.
+	// It has no version because the controller binary doesn't know its own:
+	// releases are built by ko without ldflags and only tagged afterwards.
+	// Operators who need one can set it with the user-agent configuration.
+	DefaultUserAgent = "knative-build-pipeline"
 )
 
 var toolsMount = corev1.VolumeMount{
@@ -53,27 +78,255 @@ var toolsMount = corev1.VolumeMount{
 
 // Cache is a simple caching mechanism allowing for caching the results of
 // getting the Entrypoint of a container image from a remote registry. The
-// internal lru cache is thread-safe.
+// results are kept in a Store, by default a thread-safe in-memory lru cache.
 type Cache struct {
-	lru *lru.Cache
+	store        Store
+	mirrors      map[string]string
+	dockerConfig string
+	keychain     authn.Keychain
+	transport    http.RoundTripper
+	userAgent    string
+	logger       *zap.SugaredLogger
+
+	// negative holds images that couldn't be found in the registry, so that
+	// they aren't looked up again until negativeTTL has elapsed.
+	negative    *lru.Cache
+	negativeTTL time.Duration
+	// tagTTL is how long the digests of images referenced by tag are cached,
+	// since tags can be moved to other images. Digests of images referenced
+	// by digest are cached until evicted.
+	tagTTL time.Duration
+
+	// inflight holds the lookups in progress, so that concurrent lookups of
+	// the same key share a single request to the registry.
+	inflightMu sync.Mutex
+	inflight   map[string]*lookup
+}
+
+// digestEntry is the digest an image reference resolved to, which expires at
+// Expires unless that is zero.
+type digestEntry struct {
+	Digest  string
+	Expires time.Time
+}
+
+type negativeEntry struct {
+	err     error
+	expires time.Time
+}
+
+// lookup is a lookup in progress, whose result is shared by every caller
+// looking up the same key meanwhile.
+type lookup struct {
+	wg    sync.WaitGroup
+	value interface{}
+	err   error
+}
+
+// CacheOption configures how a Cache looks up images in remote registries.
+type CacheOption func(*Cache)
+
+// WithRegistryMirrors makes the Cache fetch the images of the registries that
+// are keys of mirrors from the mirror host they map to instead, falling back
+// to their own registry for images the mirror doesn't have.
+func WithRegistryMirrors(mirrors map[string]string) CacheOption {
+	return func(c *Cache) {
+		c.mirrors = map[string]string{}
+		for registry, mirror := range mirrors {
+			// Registries are compared by their canonical name, so that
+			// docker.io matches the images of Docker Hub.
+			if reg, err := name.NewRegistry(registry, name.WeakValidation); err == nil {
+				registry = reg.RegistryStr()
+			}
+			c.mirrors[registry] = mirror
+		}
+	}
+}
+
+// WithDockerConfig makes the Cache authenticate to registries with the
+// credentials in the docker config file at path when the default keychain
+// has none for them. An empty path leaves the default keychain alone.
+func WithDockerConfig(path string) CacheOption {
+	return func(c *Cache) {
+		c.dockerConfig = path
+	}
+}
+
+// WithLogger makes the Cache report problems that don't fail lookups, such as
+// an invalid docker config file, to logger. By default they aren't reported.
+func WithLogger(logger *zap.SugaredLogger) CacheOption {
+	return func(c *Cache) {
+		c.logger = logger
+	}
+}
+
+// WithTransport makes the Cache send its requests to registries, including the
+// token exchange of registries using bearer authentication, through transport.
+// By default http.DefaultTransport is used.
+func WithTransport(transport http.RoundTripper) CacheOption {
+	return func(c *Cache) {
+		c.transport = transport
+	}
+}
+
+// WithUserAgent sets the User-Agent header of every request the Cache sends to
+// registries, which is DefaultUserAgent by default.
+func WithUserAgent(userAgent string) CacheOption {
+	return func(c *Cache) {
+		c.userAgent = userAgent
+	}
+}
+
+// WithStore makes the Cache keep its results in store instead of its own
+// in-memory lru cache, for instance to share them between controllers.
+func WithStore(store Store) CacheOption {
+	return func(c *Cache) {
+		c.store = store
+	}
+}
+
+// WithNegativeTTL sets how long images that couldn't be found in the registry
+// are remembered as missing, during which looking them up again fails without
+// contacting the registry. A zero ttl disables this.
+func WithNegativeTTL(ttl time.Duration) CacheOption {
+	return func(c *Cache) {
+		c.negativeTTL = ttl
+	}
+}
+
+// WithTagTTL sets how long the digests of images referenced by tag are cached,
+// after which they are looked up again in case the tag was moved to another
+// image. A zero ttl disables caching them.
+func WithTagTTL(ttl time.Duration) CacheOption {
+	return func(c *Cache) {
+		c.tagTTL = ttl
+	}
 }
 
 // NewCache is a simple helper function that returns a pointer to a Cache that
-// has had the internal fixed-sized lru cache initialized.
-func NewCache() (*Cache, error) {
-	lru, err := lru.New(cacheSize)
-	return &Cache{lru}, err
+// has had the internal fixed-sized lru caches initialized.
+func NewCache(opts ...CacheOption) (*Cache, error) {
+	store, err := NewMemoryStore(cacheSize)
+	if err != nil {
+		return nil, err
+	}
+	negative, err := lru.New(negativeCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cache{
+		store:       store,
+		keychain:    authn.DefaultKeychain,
+		transport:   http.DefaultTransport,
+		userAgent:   DefaultUserAgent,
+		logger:      zap.NewNop().Sugar(),
+		negative:    negative,
+		negativeTTL: DefaultNegativeTTL,
+		tagTTL:      DefaultTagTTL,
+		inflight:    map[string]*lookup{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.dockerConfig != "" {
+		c.keychain = authn.NewMultiKeychain(authn.DefaultKeychain, &dockerConfigKeychain{path: c.dockerConfig, logger: c.logger})
+	}
+	return c, nil
+}
+
+// get returns the digest cached for image, if it hasn't expired.
+func (c *Cache) get(image string) (string, bool) {
+	var e digestEntry
+	if !c.load(digestKeyPrefix+image, &e) || e.Digest == "" {
+		return "", false
+	}
+	if !e.Expires.IsZero() && time.Now().After(e.Expires) {
+		c.store.Remove(digestKeyPrefix + image)
+		return "", false
+	}
+	return e.Digest, true
+}
+
+// set caches digest for image. Unless image is referenced by digest, it
+// expires after the tag ttl of the cache.
+func (c *Cache) set(image, digest string) {
+	e := digestEntry{Digest: digest}
+	if ref, err := name.ParseReference(image, name.WeakValidation); err != nil || !isDigestReference(ref) {
+		if c.tagTTL <= 0 {
+			return
+		}
+		e.Expires = time.Now().Add(c.tagTTL)
+	}
+	c.save(digestKeyPrefix+image, e)
+}
+
+func isDigestReference(ref name.Reference) bool {
+	_, ok := ref.(name.Digest)
+	return ok
+}
+
+// load decodes the value stored for key into v, returning false if there is
+// no such value. Values that can't be decoded into v are reported and treated
+// as missing, so that they are looked up again and overwritten.
+func (c *Cache) load(key string, v interface{}) bool {
+	b, ok := c.store.Get(key)
+	if !ok {
+		return false
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		c.logger.Errorf("Failed to decode the cached value of %s, looking it up again: %v", key, err)
+		return false
+	}
+	return true
+}
+
+// save stores the encoding of v for key.
+func (c *Cache) save(key string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		c.logger.Errorf("Failed to encode the value to cache for %s: %v", key, err)
+		return
+	}
+	c.store.Set(key, b)
 }
 
-func (c *Cache) get(sha string) ([]string, bool) {
-	if ep, ok := c.lru.Get(sha); ok {
-		return ep.([]string), true
+// do calls fn and returns its result, unless a call for key is already in
+// progress, in which case it waits for that call and returns its result.
+func (c *Cache) do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	c.inflightMu.Lock()
+	if l, ok := c.inflight[key]; ok {
+		c.inflightMu.Unlock()
+		l.wg.Wait()
+		return l.value, l.err
 	}
-	return nil, false
+	l := &lookup{}
+	l.wg.Add(1)
+	c.inflight[key] = l
+	c.inflightMu.Unlock()
+
+	l.value, l.err = fn()
+	l.wg.Done()
+
+	c.inflightMu.Lock()
+	delete(c.inflight, key)
+	c.inflightMu.Unlock()
+	return l.value, l.err
+}
+
+// Invalidate removes the entry cached for key, which is a digest for an
+// entrypoint cache or an image reference for a digest cache, so that the next
+// lookup goes back to the remote registry.
+func (c *Cache) Invalidate(key string) {
+	c.store.Remove(digestKeyPrefix + key)
+	c.store.Remove(entrypointKeyPrefix + key)
+	c.negative.Remove(key)
 }
 
-func (c *Cache) set(sha string, ep []string) {
-	c.lru.Add(sha, ep)
+// InvalidateAll removes every entry from the cache, including the entries of
+// other caches sharing its Store.
+func (c *Cache) InvalidateAll() {
+	c.store.Purge()
+	c.negative.Purge()
 }
 
 // AddCopyStep will prepend a BuildStep (Container) that will
@@ -113,45 +366,156 @@ func getEnvVar(cmd, args []string) (string, error) {
 	return string(j), nil
 }
 
+// EntrypointSource is the field of an image config that the entrypoint of the
+// image was taken from.
+type EntrypointSource string
+
+const (
+	// SourceEntrypoint is used for entrypoints taken from the Entrypoint of
+	// the image config.
+	SourceEntrypoint EntrypointSource = "Entrypoint"
+	// SourceCmd is used for entrypoints taken from the Cmd of the image
+	// config, because the image has no Entrypoint.
+	SourceCmd EntrypointSource = "Cmd"
+)
+
+type entrypointEntry struct {
+	Command []string
+	Source  EntrypointSource
+}
+
 // GetRemoteEntrypoint accepts a cache of digest lookups, as well as the digest
 // to look for. If the cache does not contain the digest, it will lookup the
-// metadata from the images registry, and then commit that to the cache
-func GetRemoteEntrypoint(cache *Cache, digest string) ([]string, error) {
-	if ep, ok := cache.get(digest); ok {
-		return ep, nil
+// metadata from the images registry, and then commit that to the cache. If the
+// image has no entrypoint its cmd is used instead, and if it has neither an
+// error is returned. The returned source tells which of the two was used.
+func GetRemoteEntrypoint(cache *Cache, digest string) ([]string, EntrypointSource, error) {
+	var cached entrypointEntry
+	if cache.load(entrypointKeyPrefix+digest, &cached) && len(cached.Command) > 0 {
+		return cached.Command, cached.Source, nil
 	}
-	img, err := getRemoteImage(digest)
+	v, err := cache.do(entrypointKeyPrefix+digest, func() (interface{}, error) {
+		var e entrypointEntry
+		err := cache.fetchRemoteImage(digest, func(img v1.Image) (err error) {
+			e.Command, e.Source, err = ResolveEntrypoint(img)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		cache.save(entrypointKeyPrefix+digest, e)
+		return e, nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch remote image %s: %v", digest, err)
+		return nil, "", fmt.Errorf("couldn't get entrypoint of image %s: %v", digest, err)
 	}
+	e := v.(entrypointEntry)
+	return e.Command, e.Source, nil
+}
+
+// ResolveEntrypoint returns the command that img runs by default: the
+// entrypoint of its runtime config or, if it has none, its cmd. The returned
+// source tells which of the two was used. An error is returned if img has
+// neither.
+func ResolveEntrypoint(img v1.Image) ([]string, EntrypointSource, error) {
 	cfg, err := img.ConfigFile()
 	if err != nil {
-		return nil, fmt.Errorf("couldn't get config for image %s: %v", digest, err)
+		return nil, "", fmt.Errorf("couldn't get image config: %v", err)
+	}
+	if ep := cfg.Config.Entrypoint; len(ep) > 0 {
+		return ep, SourceEntrypoint, nil
 	}
-	cache.set(digest, cfg.ContainerConfig.Entrypoint)
-	return cfg.ContainerConfig.Entrypoint, nil
+	if cmd := cfg.Config.Cmd; len(cmd) > 0 {
+		return cmd, SourceCmd, nil
+	}
+	return nil, "", fmt.Errorf("image has neither an entrypoint nor a cmd, a command must be specified for the step")
 }
 
 // GetImageDigest tries to find and return image digest in cache, if
 // cache doesn't exists it will lookup the digest in remote image manifest
-// and then cache it
+// and then cache it. The returned digest reference doesn't include the tag of
+// the image, so all the tags of an image resolve to the same reference.
+// Digests of images referenced by tag are only cached for the tag ttl of the
+// cache.
 func GetImageDigest(cache *Cache, image string) (string, error) {
-	if digestList, ok := cache.get(image); ok && (len(digestList) > 0) {
-		return digestList[0], nil
+	if digest, ok := cache.get(image); ok {
+		return digest, nil
 	}
-	img, err := getRemoteImage(image)
+	ref, err := name.ParseReference(image, name.WeakValidation)
 	if err != nil {
-		return "", fmt.Errorf("failed to fetch remote image %s: %v", image, err)
+		return "", fmt.Errorf("couldn't parse image %s: %v", image, err)
 	}
-	digestHash, err := img.Digest()
+	v, err := cache.do(digestKeyPrefix+image, func() (interface{}, error) {
+		var digestHash v1.Hash
+		err := cache.fetchRemoteImage(image, func(img v1.Image) (err error) {
+			digestHash, err = img.Digest()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		digest := ref.Context().String() + digestSeparator + digestHash.String()
+		cache.set(image, digest)
+		return digest, nil
+	})
 	if err != nil {
 		return "", fmt.Errorf("couldn't get digest hash for image %s: %v", image, err)
 	}
-	// Parse Digest Hash struct into sha string
-	digest := fmt.Sprintf("%s%s%s", image, digestSeparator, digestHash.String())
-	cache.set(image, []string{digest})
+	return v.(string), nil
+}
+
+// Warm concurrently resolves the digest and entrypoint of each of the images,
+// populating digestCache and entrypointCache so that later lookups for those
+// images don't need to reach the remote registry. At most warmConcurrency
+// images are looked up at once, and images already being looked up by other
+// callers aren't looked up again. Images are not looked up once ctx is done.
+func Warm(ctx context.Context, entrypointCache, digestCache *Cache, images []string) error {
+	queue := make(chan string, len(images))
+	seen := map[string]struct{}{}
+	for _, image := range images {
+		if _, ok := seen[image]; !ok {
+			seen[image] = struct{}{}
+			queue <- image
+		}
+	}
+	close(queue)
 
-	return digest, nil
+	workers := len(seen)
+	if workers > warmConcurrency {
+		workers = warmConcurrency
+	}
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []string
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for image := range queue {
+				err := ctx.Err()
+				if err == nil {
+					var digest string
+					digest, err = GetImageDigest(digestCache, image)
+					if err == nil {
+						_, _, err = GetRemoteEntrypoint(entrypointCache, digest)
+					}
+				}
+				if err != nil {
+					mu.Lock()
+					errs = append(errs, fmt.Sprintf("%s: %v", image, err))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("couldn't warm entrypoint cache: %s", strings.Join(errs, "; "))
+	}
+	return nil
 }
 
 // RedirectSteps will modify each of the steps/containers such that
@@ -177,13 +541,100 @@ func RedirectSteps(steps []corev1.Container) error {
 	return nil
 }
 
-func getRemoteImage(image string) (v1.Image, error) {
+// fetchRemoteImage calls fetch with the remote image, fetched from the mirror
+// of its registry if one is configured and it has the image.
+// Images that aren't found are remembered for the negative ttl of the cache,
+// and fetching them again meanwhile returns the same error.
+func (c *Cache) fetchRemoteImage(image string, fetch func(v1.Image) error) error {
+	if e, ok := c.negative.Get(image); ok {
+		entry := e.(negativeEntry)
+		if time.Now().Before(entry.expires) {
+			return entry.err
+		}
+		c.negative.Remove(image)
+	}
+	err := c.fetchMirroredImage(image, fetch)
+	if err != nil && c.negativeTTL > 0 && isNotFound(err) {
+		c.negative.Add(image, negativeEntry{err: err, expires: time.Now().Add(c.negativeTTL)})
+	}
+	return err
+}
+
+// fetchMirroredImage fetches image from the mirror of its registry, falling
+// back to the registry itself unless the mirror refused the credentials, so
+// that a mirror that is down or lacks the image doesn't fail the lookup.
+func (c *Cache) fetchMirroredImage(image string, fetch func(v1.Image) error) error {
+	mirrored, ok := c.mirrorImage(image)
+	if !ok {
+		return c.fetchImage(image, fetch)
+	}
+	mirrorErr := c.fetchImage(mirrored, fetch)
+	if mirrorErr == nil || isUnauthorized(mirrorErr) {
+		return mirrorErr
+	}
+	if err := c.fetchImage(image, fetch); err != nil {
+		return &mirrorError{err: err, mirror: mirrored, mirrorErr: mirrorErr}
+	}
+	return nil
+}
+
+// mirrorImage returns the reference to image on the mirror of its registry,
+// and false if its registry has no mirror.
+func (c *Cache) mirrorImage(image string) (string, bool) {
+	ref, err := name.ParseReference(image, name.WeakValidation)
+	if err != nil {
+		return "", false
+	}
+	mirror, ok := c.mirrors[ref.Context().RegistryStr()]
+	if !ok {
+		return "", false
+	}
+	separator := ":"
+	if isDigestReference(ref) {
+		separator = digestSeparator
+	}
+	return mirror + "/" + ref.Context().RepositoryStr() + separator + ref.Identifier(), true
+}
+
+// fetchImage calls fetch with the remote image, authenticating with the
+// credentials from the keychain of the cache. If the registry rejects those
+// credentials, fetch is retried once anonymously so that public images can
+// still be read; the original error is returned if that fails too.
+func (c *Cache) fetchImage(image string, fetch func(v1.Image) error) error {
+	err := c.fetchImageWithAuth(image, remote.WithAuthFromKeychain(c.keychain), fetch)
+	if err == nil || !isUnauthorized(err) {
+		return err
+	}
+	if anonErr := c.fetchImageWithAuth(image, remote.WithAuth(authn.Anonymous), fetch); anonErr == nil {
+		return nil
+	}
+	return err
+}
+
+// fetchImageWithAuth calls fetch with the remote image, authenticating with
+// auth. Errors are annotated with the last error response of the registry,
+// which the registry client doesn't always report.
+func (c *Cache) fetchImageWithAuth(image string, auth remote.ImageOption, fetch func(v1.Image) error) error {
+	recorder := &responseRecorder{inner: &userAgentTransport{inner: c.transport, userAgent: c.userAgent}}
+	img, err := getRemoteImage(image, auth, remote.WithTransport(recorder))
+	if err == nil {
+		err = fetch(img)
+	}
+	if err != nil {
+		if status, body := recorder.lastError(); status != 0 {
+			return &registryError{err: err, status: status, body: body}
+		}
+	}
+	return err
+}
+
+func getRemoteImage(image string, opts ...remote.ImageOption) (v1.Image, error) {
 	// verify the image name, then download the remote config file
 	ref, err := name.ParseReference(image, name.WeakValidation)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't parse image %s: %v", image, err)
 	}
-	img, err := remote.Image(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	img, err := remote.Image(ref, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't get container image info from registry %s: %v", image, err)
 	}
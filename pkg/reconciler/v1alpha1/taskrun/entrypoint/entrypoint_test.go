@@ -1,14 +1,22 @@
 package entrypoint
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/partial"
@@ -145,7 +153,7 @@ func getDigestAsString(image v1.Image) string {
 func TestGetRemoteEntrypoint(t *testing.T) {
 	expectedEntrypoint := []string{"/bin/expected", "entrypoint"}
 	img := getImage(t, &v1.ConfigFile{
-		ContainerConfig: v1.Config{
+		Config: v1.Config{
 			Entrypoint: expectedEntrypoint,
 		},
 	})
@@ -180,18 +188,446 @@ func TestGetRemoteEntrypoint(t *testing.T) {
 	if err != nil {
 		t.Fatalf("couldn't create new entrypoint cache: %v", err)
 	}
-	ep, err := GetRemoteEntrypoint(entrypointCache, finalDigest)
+	ep, source, err := GetRemoteEntrypoint(entrypointCache, finalDigest)
 	if err != nil {
 		t.Errorf("couldn't get entrypoint remote: %v", err)
 	}
 	if !reflect.DeepEqual(ep, expectedEntrypoint) {
 		t.Errorf("entrypoints do not match: %s should be %s", ep[0], expectedEntrypoint)
 	}
+	if source != SourceEntrypoint {
+		t.Errorf("entrypoint source: got %s, want %s", source, SourceEntrypoint)
+	}
+}
+
+// newRegistryServer returns a fake registry serving the manifest and config of
+// img under the repository repo, addressable by digest or by the latest tag.
+func newRegistryServer(t *testing.T, repo string, img v1.Image) *httptest.Server {
+	configPath := fmt.Sprintf("/v2/%s/blobs/%s", repo, mustConfigName(t, img))
+	manifestPath := fmt.Sprintf("/v2/%s/manifests/%s", repo, getDigestAsString(img))
+	tagPath := fmt.Sprintf("/v2/%s/manifests/latest", repo)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case configPath:
+			w.Write(mustRawConfigFile(t, img))
+		case manifestPath, tagPath:
+			w.Write(mustRawManifest(t, img))
+		default:
+			t.Fatalf("Unexpected path: %v", r.URL.Path)
+		}
+	}))
+}
+
+func TestGetRemoteEntrypointCmdFallback(t *testing.T) {
+	expectedCmd := []string{"/bin/expected", "cmd"}
+	img := getImage(t, &v1.ConfigFile{
+		Config: v1.Config{
+			Cmd: expectedCmd,
+		},
+	})
+	server := newRegistryServer(t, "image", img)
+	defer server.Close()
+	digest := path.Join(strings.TrimPrefix(server.URL, "http://"), "image") + "@" + getDigestAsString(img)
+
+	entrypointCache, err := NewCache()
+	if err != nil {
+		t.Fatalf("couldn't create new entrypoint cache: %v", err)
+	}
+	// The second lookup is served from the cache.
+	for i := 0; i < 2; i++ {
+		ep, source, err := GetRemoteEntrypoint(entrypointCache, digest)
+		if err != nil {
+			t.Fatalf("couldn't get entrypoint remote: %v", err)
+		}
+		if !reflect.DeepEqual(ep, expectedCmd) {
+			t.Errorf("entrypoints do not match: %s should be %s", ep, expectedCmd)
+		}
+		if source != SourceCmd {
+			t.Errorf("entrypoint source: got %s, want %s", source, SourceCmd)
+		}
+		server.Close()
+	}
+}
+
+func TestGetRemoteEntrypointNoEntrypoint(t *testing.T) {
+	img := getImage(t, &v1.ConfigFile{
+		Config: v1.Config{},
+	})
+	server := newRegistryServer(t, "image", img)
+	defer server.Close()
+	digest := path.Join(strings.TrimPrefix(server.URL, "http://"), "image") + "@" + getDigestAsString(img)
+
+	entrypointCache, err := NewCache()
+	if err != nil {
+		t.Fatalf("couldn't create new entrypoint cache: %v", err)
+	}
+	if _, _, err := GetRemoteEntrypoint(entrypointCache, digest); err == nil {
+		t.Fatalf("expected an error for image %s without entrypoint or cmd", digest)
+	} else if !strings.Contains(err.Error(), digest) {
+		t.Errorf("expected error to name the image %s, got: %v", digest, err)
+	}
+	if entrypointCache.load(entrypointKeyPrefix+digest, &entrypointEntry{}) {
+		t.Errorf("image %s without entrypoint shouldn't be cached", digest)
+	}
+}
+
+func TestGetRemoteEntrypointMalformedConfig(t *testing.T) {
+	// The entrypoint is a string rather than an array of strings.
+	config := []byte(`{"config":{"Entrypoint":"/bin/expected entrypoint"}}`)
+	configDigest, configSize, err := v1.SHA256(bytes.NewReader(config))
+	if err != nil {
+		t.Fatalf("couldn't hash config: %v", err)
+	}
+	manifest := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":%q,"size":%d,"digest":%q}}`,
+		types.DockerManifestSchema2, types.DockerConfigJSON, configSize, configDigest))
+	manifestDigest, _, err := v1.SHA256(bytes.NewReader(manifest))
+	if err != nil {
+		t.Fatalf("couldn't hash manifest: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case fmt.Sprintf("/v2/image/blobs/%s", configDigest):
+			w.Write(config)
+		case fmt.Sprintf("/v2/image/manifests/%s", manifestDigest):
+			w.Write(manifest)
+		default:
+			t.Fatalf("Unexpected path: %v", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	digest := path.Join(strings.TrimPrefix(server.URL, "http://"), "image") + "@" + manifestDigest.String()
+
+	entrypointCache, err := NewCache()
+	if err != nil {
+		t.Fatalf("couldn't create new entrypoint cache: %v", err)
+	}
+	if ep, _, err := GetRemoteEntrypoint(entrypointCache, digest); err == nil {
+		t.Fatalf("expected an error for image %s with a malformed config, got entrypoint %q", digest, ep)
+	} else if !strings.Contains(err.Error(), digest) {
+		t.Errorf("expected error to name the image %s, got: %v", digest, err)
+	}
+	if entrypointCache.load(entrypointKeyPrefix+digest, &entrypointEntry{}) {
+		t.Errorf("image %s with a malformed config shouldn't be cached", digest)
+	}
+}
+
+func TestGetRemoteEntrypointAnonymousFallback(t *testing.T) {
+	expectedEntrypoint := []string{"/bin/expected", "entrypoint"}
+	img := getImage(t, &v1.ConfigFile{
+		Config: v1.Config{
+			Entrypoint: expectedEntrypoint,
+		},
+	})
+	public := newRegistryServer(t, "image", img)
+	defer public.Close()
+
+	// The registry asks for basic auth but rejects the configured credentials,
+	// while serving the public image to anonymous requests.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("Authorization") != "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errors":[{"code":"UNAUTHORIZED","message":"invalid credentials"}]}`))
+			return
+		}
+		public.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	dir, err := ioutil.TempDir("", "docker-config")
+	if err != nil {
+		t.Fatalf("couldn't create docker config dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	config := fmt.Sprintf(`{"auths":{%q:{"username":"foo","password":"bar"}}}`, host)
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600); err != nil {
+		t.Fatalf("couldn't write docker config: %v", err)
+	}
+	defer os.Setenv("DOCKER_CONFIG", os.Getenv("DOCKER_CONFIG"))
+	os.Setenv("DOCKER_CONFIG", dir)
+
+	entrypointCache, err := NewCache()
+	if err != nil {
+		t.Fatalf("couldn't create new entrypoint cache: %v", err)
+	}
+	ep, _, err := GetRemoteEntrypoint(entrypointCache, path.Join(host, "image")+"@"+getDigestAsString(img))
+	if err != nil {
+		t.Fatalf("couldn't get entrypoint of public image: %v", err)
+	}
+	if !reflect.DeepEqual(ep, expectedEntrypoint) {
+		t.Errorf("entrypoints do not match: %s should be %s", ep, expectedEntrypoint)
+	}
+}
+
+func TestGetRemoteEntrypointRegistryMirror(t *testing.T) {
+	mirroredEntrypoint := []string{"/bin/mirrored"}
+	mirroredImg := getImage(t, &v1.ConfigFile{
+		Config: v1.Config{
+			Entrypoint: mirroredEntrypoint,
+		},
+	})
+	originEntrypoint := []string{"/bin/origin"}
+	originImg := getImage(t, &v1.ConfigFile{
+		Config: v1.Config{
+			Entrypoint: originEntrypoint,
+		},
+	})
+
+	// The mirror only has the mirrored image, the origin only the other one.
+	mirrored := newRegistryServer(t, "mirrored", mirroredImg)
+	defer mirrored.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" || strings.HasPrefix(r.URL.Path, "/v2/mirrored/") {
+			mirrored.Config.Handler.ServeHTTP(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`))
+	}))
+	defer mirror.Close()
+	origin := newRegistryServer(t, "origin", originImg)
+	defer origin.Close()
+	originHost := strings.TrimPrefix(origin.URL, "http://")
+
+	entrypointCache, err := NewCache(WithRegistryMirrors(map[string]string{
+		originHost: strings.TrimPrefix(mirror.URL, "http://"),
+	}))
+	if err != nil {
+		t.Fatalf("couldn't create new entrypoint cache: %v", err)
+	}
+	for _, tc := range []struct {
+		digest string
+		want   []string
+	}{{
+		digest: path.Join(originHost, "mirrored") + "@" + getDigestAsString(mirroredImg),
+		want:   mirroredEntrypoint,
+	}, {
+		digest: path.Join(originHost, "origin") + "@" + getDigestAsString(originImg),
+		want:   originEntrypoint,
+	}} {
+		ep, _, err := GetRemoteEntrypoint(entrypointCache, tc.digest)
+		if err != nil {
+			t.Fatalf("couldn't get entrypoint of %s: %v", tc.digest, err)
+		}
+		if !reflect.DeepEqual(ep, tc.want) {
+			t.Errorf("entrypoints of %s do not match: %s should be %s", tc.digest, ep, tc.want)
+		}
+	}
+}
+
+func TestGetRemoteEntrypointUnreachableMirror(t *testing.T) {
+	expectedEntrypoint := []string{"/bin/expected", "entrypoint"}
+	img := getImage(t, &v1.ConfigFile{
+		Config: v1.Config{
+			Entrypoint: expectedEntrypoint,
+		},
+	})
+	// The origin has the image, and nothing else.
+	registry := newRegistryServer(t, "image", img)
+	defer registry.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" || strings.HasPrefix(r.URL.Path, "/v2/image/") {
+			registry.Config.Handler.ServeHTTP(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`))
+	}))
+	defer origin.Close()
+	originHost := strings.TrimPrefix(origin.URL, "http://")
+	// Nothing listens on the address of a closed server.
+	mirror := httptest.NewServer(http.NotFoundHandler())
+	mirrorHost := strings.TrimPrefix(mirror.URL, "http://")
+	mirror.Close()
+
+	entrypointCache, err := NewCache(WithRegistryMirrors(map[string]string{
+		originHost: mirrorHost,
+	}))
+	if err != nil {
+		t.Fatalf("couldn't create new entrypoint cache: %v", err)
+	}
+	digest := path.Join(originHost, "image") + "@" + getDigestAsString(img)
+	ep, _, err := GetRemoteEntrypoint(entrypointCache, digest)
+	if err != nil {
+		t.Fatalf("couldn't get entrypoint of %s: %v", digest, err)
+	}
+	if !reflect.DeepEqual(ep, expectedEntrypoint) {
+		t.Errorf("entrypoints of %s do not match: %s should be %s", digest, ep, expectedEntrypoint)
+	}
+
+	// When the registry doesn't have the image either, both errors are
+	// reported.
+	missing := path.Join(originHost, "missing") + "@" + getDigestAsString(img)
+	_, _, err = GetRemoteEntrypoint(entrypointCache, missing)
+	if err == nil {
+		t.Fatalf("expected an error getting the entrypoint of %s", missing)
+	}
+	if !entrypointCache.negative.Contains(missing) {
+		t.Errorf("expected %s to be remembered as missing, got: %v", missing, err)
+	}
+	if !strings.Contains(err.Error(), mirrorHost) {
+		t.Errorf("expected the error of %s to include the mirror's error, got: %v", missing, err)
+	}
+}
+
+func TestGetImageDigestRegistryMirrorPerRegistry(t *testing.T) {
+	mirroredImg := getImage(t, &v1.ConfigFile{
+		Config: v1.Config{
+			Entrypoint: []string{"/bin/mirrored"},
+		},
+	})
+	otherImg := getImage(t, &v1.ConfigFile{
+		Config: v1.Config{
+			Entrypoint: []string{"/bin/other"},
+		},
+	})
+
+	// Both registries have a repository named "shared", but only the first
+	// one is mirrored.
+	mirror := newRegistryServer(t, "shared", mirroredImg)
+	defer mirror.Close()
+	mirrored := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to the mirrored registry: %v", r.URL.Path)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer mirrored.Close()
+	other := newRegistryServer(t, "shared", otherImg)
+	defer other.Close()
+	mirroredHost := strings.TrimPrefix(mirrored.URL, "http://")
+	otherHost := strings.TrimPrefix(other.URL, "http://")
+
+	digestCache, err := NewCache(WithRegistryMirrors(map[string]string{
+		mirroredHost: strings.TrimPrefix(mirror.URL, "http://"),
+	}))
+	if err != nil {
+		t.Fatalf("couldn't create new digest cache: %v", err)
+	}
+	for _, tc := range []struct {
+		image string
+		want  string
+	}{{
+		image: mirroredHost + "/shared:latest",
+		want:  mirroredHost + "/shared@" + getDigestAsString(mirroredImg),
+	}, {
+		image: otherHost + "/shared:latest",
+		want:  otherHost + "/shared@" + getDigestAsString(otherImg),
+	}} {
+		digest, err := GetImageDigest(digestCache, tc.image)
+		if err != nil {
+			t.Fatalf("couldn't get digest of %s: %v", tc.image, err)
+		}
+		if digest != tc.want {
+			t.Errorf("digest of %s: got %s, want %s", tc.image, digest, tc.want)
+		}
+	}
+}
+
+func TestMirrorImage(t *testing.T) {
+	cache, err := NewCache(WithRegistryMirrors(map[string]string{
+		"docker.io": "mirror.registry.svc:5000",
+	}))
+	if err != nil {
+		t.Fatalf("couldn't create new cache: %v", err)
+	}
+	sha := "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	for _, tc := range []struct {
+		image  string
+		want   string
+		wantOk bool
+	}{{
+		image:  "busybox",
+		want:   "mirror.registry.svc:5000/library/busybox:latest",
+		wantOk: true,
+	}, {
+		image:  "index.docker.io/foo/bar@" + sha,
+		want:   "mirror.registry.svc:5000/foo/bar@" + sha,
+		wantOk: true,
+	}, {
+		image: "gcr.io/foo/bar",
+	}} {
+		got, ok := cache.mirrorImage(tc.image)
+		if got != tc.want || ok != tc.wantOk {
+			t.Errorf("mirrorImage(%s) = %s, %t; want %s, %t", tc.image, got, ok, tc.want, tc.wantOk)
+		}
+	}
+}
+
+func TestResolveEntrypoint(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		config     v1.ConfigFile
+		wantEp     []string
+		wantSource EntrypointSource
+		wantErr    bool
+	}{{
+		name: "entrypoint and cmd",
+		config: v1.ConfigFile{Config: v1.Config{
+			Entrypoint: []string{"/bin/entrypoint"},
+			Cmd:        []string{"/bin/cmd"},
+		}},
+		wantEp:     []string{"/bin/entrypoint"},
+		wantSource: SourceEntrypoint,
+	}, {
+		name: "cmd only",
+		config: v1.ConfigFile{Config: v1.Config{
+			Cmd: []string{"/bin/cmd"},
+		}},
+		wantEp:     []string{"/bin/cmd"},
+		wantSource: SourceCmd,
+	}, {
+		// Images built by the legacy docker builder record the build
+		// instruction as the cmd of their container config.
+		name: "container config of the build",
+		config: v1.ConfigFile{
+			Config: v1.Config{
+				Cmd: []string{"/bin/cmd"},
+			},
+			ContainerConfig: v1.Config{
+				Cmd: []string{"/bin/sh", "-c", "#(nop) ", `CMD ["/bin/cmd"]`},
+			},
+		},
+		wantEp:     []string{"/bin/cmd"},
+		wantSource: SourceCmd,
+	}, {
+		name: "container config only",
+		config: v1.ConfigFile{ContainerConfig: v1.Config{
+			Entrypoint: []string{"/bin/entrypoint"},
+		}},
+		wantErr: true,
+	}, {
+		name:    "neither",
+		wantErr: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			img := getImage(t, &tc.config)
+			ep, source, err := ResolveEntrypoint(img)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ResolveEntrypoint() error = %v, wantErr %t", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(ep, tc.wantEp) {
+				t.Errorf("entrypoints do not match: %s should be %s", ep, tc.wantEp)
+			}
+			if source != tc.wantSource {
+				t.Errorf("entrypoint source: got %q, want %q", source, tc.wantSource)
+			}
+		})
+	}
 }
 
 func TestGetImageDigest(t *testing.T) {
 	img := getImage(t, &v1.ConfigFile{
-		ContainerConfig: v1.Config{},
+		Config: v1.Config{},
 	})
 	digetsSha := getDigestAsString(img)
 	expectedRepo := "image"
@@ -212,7 +648,7 @@ func TestGetImageDigest(t *testing.T) {
 	}))
 	defer server.Close()
 	image := path.Join(strings.TrimPrefix(server.URL, "http://"), "image:latest")
-	expectedDigetsSha := image + "@" + digetsSha
+	expectedDigetsSha := path.Join(strings.TrimPrefix(server.URL, "http://"), "image") + "@" + digetsSha
 
 	digestCache, err := NewCache()
 	if err != nil {
@@ -227,8 +663,323 @@ func TestGetImageDigest(t *testing.T) {
 	}
 }
 
+func TestWarm(t *testing.T) {
+	expectedEntrypoint := []string{"/bin/expected", "entrypoint"}
+	img := getImage(t, &v1.ConfigFile{
+		Config: v1.Config{
+			Entrypoint: expectedEntrypoint,
+		},
+	})
+	server := newRegistryServer(t, "image", img)
+	defer server.Close()
+	image := path.Join(strings.TrimPrefix(server.URL, "http://"), "image")
+
+	entrypointCache, err := NewCache()
+	if err != nil {
+		t.Fatalf("couldn't create new entrypoint cache: %v", err)
+	}
+	digestCache, err := NewCache()
+	if err != nil {
+		t.Fatalf("couldn't create new digest cache: %v", err)
+	}
+	if err := Warm(context.Background(), entrypointCache, digestCache, []string{image, image}); err != nil {
+		t.Fatalf("couldn't warm caches: %v", err)
+	}
+
+	// Both lookups must now be served from the caches.
+	server.Close()
+	digest, err := GetImageDigest(digestCache, image)
+	if err != nil {
+		t.Fatalf("couldn't get digest from warm cache: %v", err)
+	}
+	ep, _, err := GetRemoteEntrypoint(entrypointCache, digest)
+	if err != nil {
+		t.Fatalf("couldn't get entrypoint from warm cache: %v", err)
+	}
+	if !reflect.DeepEqual(ep, expectedEntrypoint) {
+		t.Errorf("entrypoints do not match: %s should be %s", ep, expectedEntrypoint)
+	}
+}
+
+func TestWarmCancelled(t *testing.T) {
+	entrypointCache, err := NewCache()
+	if err != nil {
+		t.Fatalf("couldn't create new entrypoint cache: %v", err)
+	}
+	digestCache, err := NewCache()
+	if err != nil {
+		t.Fatalf("couldn't create new digest cache: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Warm(ctx, entrypointCache, digestCache, []string{"image:latest"}); err == nil {
+		t.Error("expected an error warming caches with a cancelled context")
+	}
+	if _, ok := digestCache.get("image:latest"); ok {
+		t.Error("image shouldn't be looked up with a cancelled context")
+	}
+}
+
+func TestWarmConcurrency(t *testing.T) {
+	img := getImage(t, &v1.ConfigFile{
+		Config: v1.Config{
+			Entrypoint: []string{"/bin/expected"},
+		},
+	})
+	var (
+		mu           sync.Mutex
+		active, peak int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		if active > peak {
+			peak = active
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}()
+		time.Sleep(10 * time.Millisecond)
+		switch {
+		case r.URL.Path == "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case strings.HasPrefix(r.URL.Path, "/v2/image/manifests/"):
+			w.Write(mustRawManifest(t, img))
+		default:
+			w.Write(mustRawConfigFile(t, img))
+		}
+	}))
+	defer server.Close()
+
+	var images []string
+	for i := 0; i < 4*warmConcurrency; i++ {
+		images = append(images, fmt.Sprintf("%s/image:tag%d", strings.TrimPrefix(server.URL, "http://"), i))
+	}
+	entrypointCache, err := NewCache()
+	if err != nil {
+		t.Fatalf("couldn't create new entrypoint cache: %v", err)
+	}
+	digestCache, err := NewCache()
+	if err != nil {
+		t.Fatalf("couldn't create new digest cache: %v", err)
+	}
+	if err := Warm(context.Background(), entrypointCache, digestCache, images); err != nil {
+		t.Fatalf("couldn't warm caches: %v", err)
+	}
+	if peak > warmConcurrency {
+		t.Errorf("expected at most %d concurrent requests, got %d", warmConcurrency, peak)
+	}
+}
+
+func TestGetImageDigestSharesInflightLookup(t *testing.T) {
+	img := getImage(t, &v1.ConfigFile{})
+	registry := newRegistryServer(t, "image", img)
+	defer registry.Close()
+
+	// The manifest is only served once every caller had the time to start
+	// looking it up.
+	release := make(chan struct{})
+	var manifestRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			atomic.AddInt32(&manifestRequests, 1)
+			<-release
+		}
+		registry.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	image := path.Join(strings.TrimPrefix(server.URL, "http://"), "image")
+
+	digestCache, err := NewCache()
+	if err != nil {
+		t.Fatalf("couldn't create new digest cache: %v", err)
+	}
+	const callers = 5
+	digests := make(chan string, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			digest, err := GetImageDigest(digestCache, image)
+			if err != nil {
+				t.Errorf("couldn't get digest of %s: %v", image, err)
+			}
+			digests <- digest
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	want := image + "@" + getDigestAsString(img)
+	for i := 0; i < callers; i++ {
+		if digest := <-digests; digest != want {
+			t.Errorf("digest: got %s, want %s", digest, want)
+		}
+	}
+	if got := atomic.LoadInt32(&manifestRequests); got != 1 {
+		t.Errorf("expected a single manifest request, got %d", got)
+	}
+}
+
+func TestGetImageDigestNegativeCache(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		opts         []CacheOption
+		wantRequests int
+	}{{
+		name:         "default ttl",
+		wantRequests: 1,
+	}, {
+		name:         "disabled",
+		opts:         []CacheOption{WithNegativeTTL(0)},
+		wantRequests: 2,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/v2/" {
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+				requests++
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`))
+			}))
+			defer server.Close()
+			image := path.Join(strings.TrimPrefix(server.URL, "http://"), "deleted")
+
+			digestCache, err := NewCache(tc.opts...)
+			if err != nil {
+				t.Fatalf("couldn't create new digest cache: %v", err)
+			}
+			for i := 0; i < 2; i++ {
+				if _, err := GetImageDigest(digestCache, image); err == nil {
+					t.Fatalf("expected an error getting the digest of deleted image %s", image)
+				}
+			}
+			if requests != tc.wantRequests {
+				t.Errorf("expected %d registry requests for the deleted image, got %d", tc.wantRequests, requests)
+			}
+		})
+	}
+}
+
+func TestGetRemoteEntrypointTagsSharingDigest(t *testing.T) {
+	expectedEntrypoint := []string{"/bin/expected", "entrypoint"}
+	img := getImage(t, &v1.ConfigFile{
+		Config: v1.Config{
+			Entrypoint: expectedEntrypoint,
+		},
+	})
+	configPath := fmt.Sprintf("/v2/image/blobs/%s", mustConfigName(t, img))
+	configRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case configPath:
+			configRequests++
+			w.Write(mustRawConfigFile(t, img))
+		case "/v2/image/manifests/v1", "/v2/image/manifests/latest", "/v2/image/manifests/" + getDigestAsString(img):
+			w.Write(mustRawManifest(t, img))
+		default:
+			t.Fatalf("Unexpected path: %v", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	repo := path.Join(strings.TrimPrefix(server.URL, "http://"), "image")
+
+	entrypointCache, err := NewCache()
+	if err != nil {
+		t.Fatalf("couldn't create new entrypoint cache: %v", err)
+	}
+	digestCache, err := NewCache()
+	if err != nil {
+		t.Fatalf("couldn't create new digest cache: %v", err)
+	}
+	for _, image := range []string{repo + ":v1", repo + ":latest"} {
+		digest, err := GetImageDigest(digestCache, image)
+		if err != nil {
+			t.Fatalf("couldn't get digest of %s: %v", image, err)
+		}
+		ep, _, err := GetRemoteEntrypoint(entrypointCache, digest)
+		if err != nil {
+			t.Fatalf("couldn't get entrypoint of %s: %v", image, err)
+		}
+		if !reflect.DeepEqual(ep, expectedEntrypoint) {
+			t.Errorf("entrypoints of %s do not match: %s should be %s", image, ep, expectedEntrypoint)
+		}
+	}
+	if configRequests != 1 {
+		t.Errorf("expected the config of tags sharing a digest to be fetched once, got %d requests", configRequests)
+	}
+}
+
+func TestGetImageDigestTagTTL(t *testing.T) {
+	first := getImage(t, &v1.ConfigFile{
+		Config: v1.Config{
+			Entrypoint: []string{"/bin/first"},
+		},
+	})
+	second := getImage(t, &v1.ConfigFile{
+		Config: v1.Config{
+			Entrypoint: []string{"/bin/second"},
+		},
+	})
+	var (
+		mu     sync.Mutex
+		tagged = first
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		img := tagged
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case "/v2/image/manifests/latest", "/v2/image/manifests/" + getDigestAsString(img):
+			w.Write(mustRawManifest(t, img))
+		default:
+			t.Fatalf("Unexpected path: %v", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	repo := path.Join(strings.TrimPrefix(server.URL, "http://"), "image")
+
+	const ttl = 100 * time.Millisecond
+	digestCache, err := NewCache(WithTagTTL(ttl))
+	if err != nil {
+		t.Fatalf("couldn't create new digest cache: %v", err)
+	}
+	pinned := repo + "@" + getDigestAsString(first)
+	for _, image := range []string{repo + ":latest", pinned} {
+		if digest, err := GetImageDigest(digestCache, image); err != nil || digest != pinned {
+			t.Fatalf("GetImageDigest(%s) = %s, %v; want %s, nil", image, digest, err, pinned)
+		}
+	}
+
+	// The tag is moved to the second image, which is only noticed once the
+	// cached digest of the tag expires.
+	mu.Lock()
+	tagged = second
+	mu.Unlock()
+	if digest, err := GetImageDigest(digestCache, repo+":latest"); err != nil || digest != pinned {
+		t.Errorf("GetImageDigest() before the ttl = %s, %v; want %s, nil", digest, err, pinned)
+	}
+	time.Sleep(2 * ttl)
+	want := repo + "@" + getDigestAsString(second)
+	if digest, err := GetImageDigest(digestCache, repo+":latest"); err != nil || digest != want {
+		t.Errorf("GetImageDigest() after the ttl = %s, %v; want %s, nil", digest, err, want)
+	}
+	// Images referenced by digest don't expire.
+	if digest, ok := digestCache.get(pinned); !ok || digest != pinned {
+		t.Errorf("digest of %s: got %s, %t; want %s, true", pinned, digest, ok, pinned)
+	}
+}
+
 func TestEntrypointCacheLRU(t *testing.T) {
-	entrypoint := []string{"/bin/expected", "entrypoint"}
+	digest := "image@sha256:1"
 	entrypointCache, err := NewCache()
 	if err != nil {
 		t.Fatalf("couldn't create new entrypoint cache: %v", err)
@@ -236,7 +987,7 @@ func TestEntrypointCacheLRU(t *testing.T) {
 
 	for i := 0; i < cacheSize+exceedCacheSize; i++ {
 		image := fmt.Sprintf("image%d:latest", i)
-		entrypointCache.set(image, entrypoint)
+		entrypointCache.set(image, digest)
 	}
 	for i := 0; i < exceedCacheSize; i++ {
 		image := fmt.Sprintf("image%d:latest", i)
@@ -252,6 +1003,50 @@ func TestEntrypointCacheLRU(t *testing.T) {
 	}
 }
 
+func TestEntrypointCacheInvalidate(t *testing.T) {
+	entrypointCache, err := NewCache()
+	if err != nil {
+		t.Fatalf("couldn't create new entrypoint cache: %v", err)
+	}
+	images := []string{"image@sha256:1", "image@sha256:2", "image@sha256:3"}
+	for _, image := range images {
+		entrypointCache.set(image, image)
+		entrypointCache.save(entrypointKeyPrefix+image, entrypointEntry{Command: []string{"/bin/" + image}, Source: SourceEntrypoint})
+		entrypointCache.negative.Add(image, negativeEntry{err: errors.New("not found"), expires: time.Now().Add(time.Minute)})
+	}
+	// cached returns the kinds of entries the cache has for image.
+	cached := func(image string) []string {
+		var kinds []string
+		if _, ok := entrypointCache.get(image); ok {
+			kinds = append(kinds, "digest")
+		}
+		if entrypointCache.load(entrypointKeyPrefix+image, &entrypointEntry{}) {
+			kinds = append(kinds, "entrypoint")
+		}
+		if entrypointCache.negative.Contains(image) {
+			kinds = append(kinds, "negative")
+		}
+		return kinds
+	}
+
+	entrypointCache.Invalidate("image@sha256:1")
+	if got := cached("image@sha256:1"); len(got) != 0 {
+		t.Errorf("the %v entries of image@sha256:1 should be invalidated", got)
+	}
+	for _, image := range images[1:] {
+		if got, want := cached(image), []string{"digest", "entrypoint", "negative"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("the entries of %s shouldn't be invalidated: got %v, want %v", image, got, want)
+		}
+	}
+
+	entrypointCache.InvalidateAll()
+	for _, image := range images {
+		if got := cached(image); len(got) != 0 {
+			t.Errorf("the %v entries of %s should be invalidated", got, image)
+		}
+	}
+}
+
 func TestAddCopyStep(t *testing.T) {
 	cfg := &config.Config{
 		Entrypoint: &config.Entrypoint{
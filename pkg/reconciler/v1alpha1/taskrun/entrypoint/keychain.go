@@ -0,0 +1,107 @@
+/*
+Copyright 2018 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entrypoint
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"go.uber.org/zap"
+)
+
+// registryForms are the ways a registry may be written as a key of the auths
+// of a docker config file.
+var registryForms = []string{
+	"%s",
+	"https://%s",
+	"http://%s",
+	"https://%s/v1/",
+	"http://%s/v1/",
+	"https://%s/v2/",
+	"http://%s/v2/",
+}
+
+type dockerConfigEntry struct {
+	Auth     string `json:"auth"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type dockerConfigFile struct {
+	Auths map[string]dockerConfigEntry `json:"auths"`
+}
+
+// dockerConfigKeychain resolves credentials from the auths of the docker
+// config file at path. The file is read on each lookup so that updates to a
+// mounted secret are picked up. Like authn.DefaultKeychain, it resolves
+// anonymous credentials when the file doesn't exist; when it can't be used,
+// that is reported to logger rather than failing the lookup.
+type dockerConfigKeychain struct {
+	path   string
+	logger *zap.SugaredLogger
+}
+
+var _ authn.Keychain = (*dockerConfigKeychain)(nil)
+
+// Resolve implements authn.Keychain.
+func (k *dockerConfigKeychain) Resolve(reg name.Registry) (authn.Authenticator, error) {
+	auth, err := k.resolve(reg)
+	if err != nil {
+		k.logger.Errorf("Failed to resolve credentials for %s from docker config %s: %v", reg.Name(), k.path, err)
+		return authn.Anonymous, nil
+	}
+	return auth, nil
+}
+
+func (k *dockerConfigKeychain) resolve(reg name.Registry) (authn.Authenticator, error) {
+	content, err := ioutil.ReadFile(k.path)
+	if os.IsNotExist(err) {
+		return authn.Anonymous, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read docker config: %v", err)
+	}
+	var cfg dockerConfigFile
+	if err := json.Unmarshal(content, &cfg); err != nil {
+		return nil, fmt.Errorf("couldn't parse docker config: %v", err)
+	}
+	for _, form := range registryForms {
+		entry, ok := cfg.Auths[fmt.Sprintf(form, reg.Name())]
+		if !ok {
+			continue
+		}
+		if entry.Auth == "" {
+			return &authn.Basic{Username: entry.Username, Password: entry.Password}, nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode auth: %v", err)
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed auth")
+		}
+		return &authn.Basic{Username: parts[0], Password: parts[1]}, nil
+	}
+	return authn.Anonymous, nil
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2018 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entrypoint
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestDockerConfigKeychain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-config")
+	if err != nil {
+		t.Fatalf("couldn't create docker config dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	// "Zm9vOmJhcg==" is the base64 encoding of "foo:bar".
+	config := `{"auths":{
+		"auth.registry.io":{"auth":"Zm9vOmJhcg=="},
+		"https://basic.registry.io/v2/":{"username":"baz","password":"qux"}
+	}}`
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatalf("couldn't write docker config: %v", err)
+	}
+
+	for _, tc := range []struct {
+		registry string
+		want     string
+	}{{
+		registry: "auth.registry.io",
+		want:     "Basic Zm9vOmJhcg==",
+	}, {
+		registry: "basic.registry.io",
+		// "YmF6OnF1eA==" is the base64 encoding of "baz:qux".
+		want: "Basic YmF6OnF1eA==",
+	}} {
+		reg, err := name.NewRegistry(tc.registry, name.WeakValidation)
+		if err != nil {
+			t.Fatalf("couldn't parse registry %s: %v", tc.registry, err)
+		}
+		auth, err := (&dockerConfigKeychain{path: path, logger: zap.NewNop().Sugar()}).Resolve(reg)
+		if err != nil {
+			t.Fatalf("couldn't resolve credentials for %s: %v", tc.registry, err)
+		}
+		got, err := auth.Authorization()
+		if err != nil {
+			t.Fatalf("couldn't get authorization for %s: %v", tc.registry, err)
+		}
+		if got != tc.want {
+			t.Errorf("authorization for %s: got %q, want %q", tc.registry, got, tc.want)
+		}
+	}
+
+	reg, err := name.NewRegistry("other.registry.io", name.WeakValidation)
+	if err != nil {
+		t.Fatalf("couldn't parse registry: %v", err)
+	}
+	if auth, err := (&dockerConfigKeychain{path: path, logger: zap.NewNop().Sugar()}).Resolve(reg); err != nil {
+		t.Errorf("couldn't resolve credentials for other.registry.io: %v", err)
+	} else if auth != authn.Anonymous {
+		t.Errorf("expected anonymous credentials for other.registry.io, got %v", auth)
+	}
+}
+
+func TestDockerConfigKeychainInvalidConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-config")
+	if err != nil {
+		t.Fatalf("couldn't create docker config dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	malformed := filepath.Join(dir, "malformed.json")
+	if err := ioutil.WriteFile(malformed, []byte(`{"auths":`), 0600); err != nil {
+		t.Fatalf("couldn't write docker config: %v", err)
+	}
+	reg, err := name.NewRegistry("registry.io", name.WeakValidation)
+	if err != nil {
+		t.Fatalf("couldn't parse registry: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		path     string
+		wantLogs int
+	}{{
+		name: "missing",
+		path: filepath.Join(dir, "missing.json"),
+	}, {
+		name:     "malformed",
+		path:     malformed,
+		wantLogs: 1,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			core, logs := observer.New(zap.InfoLevel)
+			keychain := &dockerConfigKeychain{path: tc.path, logger: zap.New(core).Sugar()}
+			auth, err := keychain.Resolve(reg)
+			if err != nil {
+				t.Fatalf("couldn't resolve credentials: %v", err)
+			}
+			if auth != authn.Anonymous {
+				t.Errorf("expected anonymous credentials, got %v", auth)
+			}
+			if got := logs.Len(); got != tc.wantLogs {
+				t.Errorf("expected %d logged errors, got %d: %v", tc.wantLogs, got, logs.All())
+			}
+		})
+	}
+}
+
+func TestGetRemoteEntrypointMissingDockerConfig(t *testing.T) {
+	expectedEntrypoint := []string{"/bin/expected", "entrypoint"}
+	img := getImage(t, &v1.ConfigFile{
+		Config: v1.Config{
+			Entrypoint: expectedEntrypoint,
+		},
+	})
+	server := newRegistryServer(t, "image", img)
+	defer server.Close()
+	digest := path.Join(strings.TrimPrefix(server.URL, "http://"), "image") + "@" + getDigestAsString(img)
+
+	cache, err := NewCache(WithDockerConfig("/does/not/exist/config.json"))
+	if err != nil {
+		t.Fatalf("couldn't create new cache: %v", err)
+	}
+	ep, _, err := GetRemoteEntrypoint(cache, digest)
+	if err != nil {
+		t.Fatalf("couldn't get entrypoint with a missing docker config: %v", err)
+	}
+	if !reflect.DeepEqual(ep, expectedEntrypoint) {
+		t.Errorf("entrypoints do not match: %s should be %s", ep, expectedEntrypoint)
+	}
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2018 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entrypoint
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// maxErrorBody is the maximum length of a registry error response body that
+// is included in errors.
+const maxErrorBody = 1024
+
+// registryError is an error caused by an error response of the registry.
+type registryError struct {
+	err    error
+	status int
+	body   string
+}
+
+func (e *registryError) Error() string {
+	if e.body == "" {
+		return fmt.Sprintf("%v (registry responded %d %s)", e.err, e.status, http.StatusText(e.status))
+	}
+	return fmt.Sprintf("%v (registry responded %d %s: %s)", e.err, e.status, http.StatusText(e.status), e.body)
+}
+
+// mirrorError is the error of looking up an image from its registry after
+// looking it up from the mirror of the registry failed too.
+type mirrorError struct {
+	err       error
+	mirror    string
+	mirrorErr error
+}
+
+func (e *mirrorError) Error() string {
+	return fmt.Sprintf("%v (mirror %s: %v)", e.err, e.mirror, e.mirrorErr)
+}
+
+// responseRecorder is an http.RoundTripper remembering the status and body of
+// the last response from the registry if it was an error.
+type responseRecorder struct {
+	inner http.RoundTripper
+
+	mu     sync.Mutex
+	status int
+	body   string
+}
+
+var _ http.RoundTripper = (*responseRecorder)(nil)
+
+// RoundTrip implements http.RoundTripper.
+func (r *responseRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.inner.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	status, body := 0, ""
+	if resp.StatusCode >= http.StatusBadRequest {
+		// Only the beginning of the body is read for the error, the client
+		// still gets the whole of it.
+		b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody+1))
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		resp.Body = &replayedBody{Reader: io.MultiReader(bytes.NewReader(b), resp.Body), Closer: resp.Body}
+		status, body = resp.StatusCode, strings.TrimSpace(string(b))
+		if len(b) > maxErrorBody {
+			body = strings.TrimSpace(string(b[:maxErrorBody])) + "..."
+		}
+	}
+	r.mu.Lock()
+	r.status, r.body = status, body
+	r.mu.Unlock()
+	return resp, nil
+}
+
+// replayedBody is a response body whose beginning was already read, made of
+// the read bytes followed by the rest of the original body.
+type replayedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// lastError returns the status and body of the last response if it was an
+// error, or a zero status otherwise.
+func (r *responseRecorder) lastError() (int, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status, r.body
+}
+
+// userAgentTransport is an http.RoundTripper setting the User-Agent header of
+// each request, replacing the one set by the registry client.
+type userAgentTransport struct {
+	inner     http.RoundTripper
+	userAgent string
+}
+
+var _ http.RoundTripper = (*userAgentTransport)(nil)
+
+// RoundTrip implements http.RoundTripper.
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.userAgent == "" {
+		return t.inner.RoundTrip(req)
+	}
+	// A RoundTripper mustn't modify the request, so the header is set on a
+	// copy of it.
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("User-Agent", t.userAgent)
+	return t.inner.RoundTrip(r)
+}
+
+// isUnauthorized returns true if err reports that the registry refused the
+// request because of missing or invalid credentials.
+func isUnauthorized(err error) bool {
+	if merr, ok := err.(*mirrorError); ok {
+		err = merr.err
+	}
+	if rerr, ok := err.(*registryError); ok {
+		return rerr.status == http.StatusUnauthorized || rerr.status == http.StatusForbidden
+	}
+	if rerr, ok := err.(*remote.Error); ok {
+		for _, d := range rerr.Errors {
+			if d.Code == remote.UnauthorizedErrorCode || d.Code == remote.DeniedErrorCode {
+				return true
+			}
+		}
+		return false
+	}
+	// Registries that don't return a structured error are only reported by
+	// status code.
+	msg := err.Error()
+	return strings.Contains(msg, "status code 401") || strings.Contains(msg, "status code 403")
+}
+
+// isNotFound returns true if err reports that the registry doesn't have the
+// requested image.
+func isNotFound(err error) bool {
+	if merr, ok := err.(*mirrorError); ok {
+		err = merr.err
+	}
+	if rerr, ok := err.(*registryError); ok {
+		return rerr.status == http.StatusNotFound
+	}
+	if rerr, ok := err.(*remote.Error); ok {
+		for _, d := range rerr.Errors {
+			switch d.Code {
+			case remote.ManifestUnknownErrorCode, remote.NameUnknownErrorCode, remote.BlobUnknownErrorCode:
+				return true
+			}
+		}
+		return false
+	}
+	return strings.Contains(err.Error(), "status code 404")
+}
@@ -0,0 +1,318 @@
+/*
+Copyright 2018 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entrypoint
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestGetImageDigestRegistryErrorResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+		want    []string
+	}{{
+		name: "ping denied",
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("access denied: client IP is not allowlisted"))
+		},
+		want: []string{"403 Forbidden", "access denied: client IP is not allowlisted"},
+	}, {
+		name: "manifest denied",
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v2/" {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":[{"code":"DENIED","message":"repository is private"}]}`))
+		},
+		want: []string{"403 Forbidden", "repository is private"},
+	}, {
+		name: "manifest unknown",
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v2/" {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`))
+		},
+		want: []string{"404 Not Found", "manifest unknown"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(tc.handler)
+			defer server.Close()
+			image := path.Join(strings.TrimPrefix(server.URL, "http://"), "image")
+
+			digestCache, err := NewCache()
+			if err != nil {
+				t.Fatalf("couldn't create new digest cache: %v", err)
+			}
+			_, err = GetImageDigest(digestCache, image)
+			if err == nil {
+				t.Fatalf("expected an error getting the digest of %s", image)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected error to contain %q, got: %v", want, err)
+				}
+			}
+		})
+	}
+}
+
+// countingReader is an io.Reader counting the bytes read from it.
+type countingReader struct {
+	r    *strings.Reader
+	read int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += n
+	return n, err
+}
+
+// bodyTransport is an http.RoundTripper responding with status and body.
+type bodyTransport struct {
+	status int
+	body   *countingReader
+}
+
+func (t *bodyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: t.status, Body: ioutil.NopCloser(t.body)}, nil
+}
+
+func TestResponseRecorderLargeErrorBody(t *testing.T) {
+	content := strings.Repeat("a", 10*maxErrorBody)
+	body := &countingReader{r: strings.NewReader(content)}
+	recorder := &responseRecorder{inner: &bodyTransport{status: http.StatusForbidden, body: body}}
+
+	req, err := http.NewRequest(http.MethodGet, "http://registry.io/v2/", nil)
+	if err != nil {
+		t.Fatalf("couldn't create request: %v", err)
+	}
+	resp, err := recorder.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() = %v", err)
+	}
+	if body.read > maxErrorBody+1 {
+		t.Errorf("expected at most %d bytes of the body to be read for the error, got %d", maxErrorBody+1, body.read)
+	}
+	status, got := recorder.lastError()
+	if want := content[:maxErrorBody] + "..."; status != http.StatusForbidden || got != want {
+		t.Errorf("lastError() = %d, %d bytes; want %d, %d bytes", status, len(got), http.StatusForbidden, len(want))
+	}
+
+	// The client still reads the whole body.
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("couldn't read response body: %v", err)
+	}
+	if string(b) != content {
+		t.Errorf("expected the client to read the %d bytes of the body, got %d", len(content), len(b))
+	}
+}
+
+// headerTransport is an http.RoundTripper adding a header to each request.
+type headerTransport struct {
+	inner  http.RoundTripper
+	header string
+	value  string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Header.Set(t.header, t.value)
+	return t.inner.RoundTrip(req)
+}
+
+func TestGetRemoteEntrypointCustomTransport(t *testing.T) {
+	expectedEntrypoint := []string{"/bin/expected", "entrypoint"}
+	img := getImage(t, &v1.ConfigFile{
+		Config: v1.Config{
+			Entrypoint: expectedEntrypoint,
+		},
+	})
+	registry := newRegistryServer(t, "image", img)
+	defer registry.Close()
+
+	// The registry sits behind a gateway that requires a header which only
+	// the custom transport sets.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Egress-Token") != "secret" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		registry.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	digest := path.Join(strings.TrimPrefix(server.URL, "http://"), "image") + "@" + getDigestAsString(img)
+
+	entrypointCache, err := NewCache(WithTransport(&headerTransport{
+		inner:  http.DefaultTransport,
+		header: "X-Egress-Token",
+		value:  "secret",
+	}))
+	if err != nil {
+		t.Fatalf("couldn't create new entrypoint cache: %v", err)
+	}
+	ep, _, err := GetRemoteEntrypoint(entrypointCache, digest)
+	if err != nil {
+		t.Fatalf("couldn't get entrypoint through the custom transport: %v", err)
+	}
+	if !reflect.DeepEqual(ep, expectedEntrypoint) {
+		t.Errorf("entrypoints do not match: %s should be %s", ep, expectedEntrypoint)
+	}
+}
+
+func TestGetEntrypointRegistryWithPort(t *testing.T) {
+	expectedEntrypoint := []string{"/bin/expected", "entrypoint"}
+	img := getImage(t, &v1.ConfigFile{
+		Config: v1.Config{
+			Entrypoint: expectedEntrypoint,
+		},
+	})
+	registry := newRegistryServer(t, "ns/img", img)
+	defer registry.Close()
+	server := httptest.NewTLSServer(registry.Config.Handler)
+	defer server.Close()
+
+	// Send requests for any registry to the test server.
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	for _, image := range []string{
+		"registry.internal:5000/ns/img",
+		"registry.internal:5000/ns/img:latest",
+		"registry.internal:5000/ns/img@" + getDigestAsString(img),
+	} {
+		t.Run(image, func(t *testing.T) {
+			cache, err := NewCache(WithTransport(transport))
+			if err != nil {
+				t.Fatalf("couldn't create new cache: %v", err)
+			}
+			digest, err := GetImageDigest(cache, image)
+			if err != nil {
+				t.Fatalf("couldn't get digest of %s: %v", image, err)
+			}
+			if want := "registry.internal:5000/ns/img@" + getDigestAsString(img); digest != want {
+				t.Errorf("digest of %s: got %s, want %s", image, digest, want)
+			}
+			ep, _, err := GetRemoteEntrypoint(cache, digest)
+			if err != nil {
+				t.Fatalf("couldn't get entrypoint of %s: %v", digest, err)
+			}
+			if !reflect.DeepEqual(ep, expectedEntrypoint) {
+				t.Errorf("entrypoints do not match: %s should be %s", ep, expectedEntrypoint)
+			}
+		})
+	}
+}
+
+// roundTripFunc is an http.RoundTripper calling itself.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestUserAgentTransportDoesNotModifyRequest(t *testing.T) {
+	var sent string
+	transport := &userAgentTransport{
+		inner: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			sent = req.Header.Get("User-Agent")
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}),
+		userAgent: "custom-agent",
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://registry.io/v2/", nil)
+	if err != nil {
+		t.Fatalf("couldn't create request: %v", err)
+	}
+	req.Header.Set("User-Agent", "client-agent")
+	if _, err := transport.RoundTrip(req); err != nil {
+		t.Fatalf("RoundTrip() = %v", err)
+	}
+	if sent != "custom-agent" {
+		t.Errorf("expected the request to be sent with User-Agent %q, got %q", "custom-agent", sent)
+	}
+	if got := req.Header.Get("User-Agent"); got != "client-agent" {
+		t.Errorf("expected the User-Agent of the caller's request to stay %q, got %q", "client-agent", got)
+	}
+}
+
+func TestGetImageDigestUserAgent(t *testing.T) {
+	img := getImage(t, &v1.ConfigFile{})
+	registry := newRegistryServer(t, "image", img)
+	defer registry.Close()
+
+	for _, tc := range []struct {
+		name string
+		opts []CacheOption
+		want string
+	}{{
+		name: "default",
+		want: DefaultUserAgent,
+	}, {
+		name: "custom",
+		opts: []CacheOption{WithUserAgent("my-controller/1.0")},
+		want: "my-controller/1.0",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			var userAgents []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				userAgents = append(userAgents, r.UserAgent())
+				registry.Config.Handler.ServeHTTP(w, r)
+			}))
+			defer server.Close()
+			image := path.Join(strings.TrimPrefix(server.URL, "http://"), "image")
+
+			cache, err := NewCache(tc.opts...)
+			if err != nil {
+				t.Fatalf("couldn't create new cache: %v", err)
+			}
+			if _, err := GetImageDigest(cache, image); err != nil {
+				t.Fatalf("couldn't get digest of %s: %v", image, err)
+			}
+			if len(userAgents) == 0 {
+				t.Fatal("expected requests to the registry")
+			}
+			for _, ua := range userAgents {
+				if ua != tc.want {
+					t.Errorf("User-Agent: got %q, want %q", ua, tc.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2018 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entrypoint
+
+import (
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// Store is where a Cache keeps the digests and entrypoints it looked up, as
+// JSON encoded values keyed by image reference or digest. Implementations must
+// be safe for concurrent use, and can be shared between controllers so that
+// each image is looked up only once.
+type Store interface {
+	// Get returns the value stored for key, if any.
+	Get(key string) ([]byte, bool)
+	// Set stores value for key.
+	Set(key string, value []byte)
+	// Remove removes the value stored for key, if any.
+	Remove(key string)
+	// Purge removes every stored value.
+	Purge()
+}
+
+// memoryStore is an in-memory Store holding a fixed number of values, evicting
+// the least recently used ones.
+type memoryStore struct {
+	lru *lru.Cache
+}
+
+var _ Store = (*memoryStore)(nil)
+
+// NewMemoryStore returns an in-memory Store holding up to size values.
+func NewMemoryStore(size int) (Store, error) {
+	lru, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryStore{lru}, nil
+}
+
+// Get implements Store.
+func (s *memoryStore) Get(key string) ([]byte, bool) {
+	if v, ok := s.lru.Get(key); ok {
+		return v.([]byte), true
+	}
+	return nil, false
+}
+
+// Set implements Store.
+func (s *memoryStore) Set(key string, value []byte) {
+	s.lru.Add(key, value)
+}
+
+// Remove implements Store.
+func (s *memoryStore) Remove(key string) {
+	s.lru.Remove(key)
+}
+
+// Purge implements Store.
+func (s *memoryStore) Purge() {
+	s.lru.Purge()
+}
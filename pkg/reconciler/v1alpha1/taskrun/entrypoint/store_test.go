@@ -0,0 +1,182 @@
+/*
+Copyright 2018 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entrypoint
+
+import (
+	"encoding/json"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store, err := NewMemoryStore(2)
+	if err != nil {
+		t.Fatalf("couldn't create new memory store: %v", err)
+	}
+
+	store.Set("a", []byte(`"a"`))
+	store.Set("b", []byte(`"b"`))
+	if v, ok := store.Get("a"); !ok || string(v) != `"a"` {
+		t.Errorf("Get(a) = %s, %t; want \"a\", true", v, ok)
+	}
+
+	// "b" is now the least recently used value, so it's evicted.
+	store.Set("c", []byte(`"c"`))
+	if _, ok := store.Get("b"); ok {
+		t.Error("value of b should be evicted")
+	}
+
+	store.Remove("a")
+	if _, ok := store.Get("a"); ok {
+		t.Error("value of a should be removed")
+	}
+
+	store.Purge()
+	if _, ok := store.Get("c"); ok {
+		t.Error("value of c should be purged")
+	}
+}
+
+// mapStore stands in for a Store shared between controllers. It's not safe for
+// concurrent use, which these tests don't need.
+type mapStore map[string][]byte
+
+func (s mapStore) Get(key string) ([]byte, bool) {
+	v, ok := s[key]
+	return v, ok
+}
+
+func (s mapStore) Set(key string, value []byte) {
+	s[key] = value
+}
+
+func (s mapStore) Remove(key string) {
+	delete(s, key)
+}
+
+func (s mapStore) Purge() {
+	for key := range s {
+		delete(s, key)
+	}
+}
+
+func TestCacheWithStore(t *testing.T) {
+	store := mapStore{}
+	cache, err := NewCache(WithStore(store))
+	if err != nil {
+		t.Fatalf("couldn't create new cache: %v", err)
+	}
+	cache.set("image:latest", "image@sha256:1")
+	var stored digestEntry
+	if err := json.Unmarshal(store["digest/image:latest"], &stored); err != nil || stored.Digest != "image@sha256:1" {
+		t.Errorf("stored digest: got %s, want image@sha256:1", store["digest/image:latest"])
+	}
+
+	// Values set by other controllers sharing the store are used.
+	store["entrypoint/image@sha256:1"] = []byte(`{"Command":["/bin/expected"],"Source":"Cmd"}`)
+	ep, source, err := GetRemoteEntrypoint(cache, "image@sha256:1")
+	if err != nil {
+		t.Fatalf("couldn't get entrypoint from store: %v", err)
+	}
+	if len(ep) != 1 || ep[0] != "/bin/expected" || source != SourceCmd {
+		t.Errorf("entrypoint from store: got %q from %s, want [\"/bin/expected\"] from %s", ep, source, SourceCmd)
+	}
+	if digest, err := GetImageDigest(cache, "image:latest"); err != nil || digest != "image@sha256:1" {
+		t.Errorf("GetImageDigest() = %s, %v; want image@sha256:1, nil", digest, err)
+	}
+}
+
+func TestCachesSharingStore(t *testing.T) {
+	expectedEntrypoint := []string{"/bin/expected", "entrypoint"}
+	img := getImage(t, &v1.ConfigFile{
+		Config: v1.Config{
+			Entrypoint: expectedEntrypoint,
+		},
+	})
+	server := newRegistryServer(t, "image", img)
+	defer server.Close()
+	digest := path.Join(strings.TrimPrefix(server.URL, "http://"), "image") + "@" + getDigestAsString(img)
+
+	store := mapStore{}
+	entrypointCache, err := NewCache(WithStore(store))
+	if err != nil {
+		t.Fatalf("couldn't create new entrypoint cache: %v", err)
+	}
+	digestCache, err := NewCache(WithStore(store))
+	if err != nil {
+		t.Fatalf("couldn't create new digest cache: %v", err)
+	}
+	// The image is pinned by digest, so both caches look up the same key.
+	if got, err := GetImageDigest(digestCache, digest); err != nil || got != digest {
+		t.Fatalf("GetImageDigest() = %s, %v; want %s, nil", got, err, digest)
+	}
+	if _, _, err := GetRemoteEntrypoint(entrypointCache, digest); err != nil {
+		t.Fatalf("couldn't get entrypoint: %v", err)
+	}
+
+	// Both lookups must now be served from the store.
+	server.Close()
+	if got, err := GetImageDigest(digestCache, digest); err != nil || got != digest {
+		t.Errorf("GetImageDigest() from store = %s, %v; want %s, nil", got, err, digest)
+	}
+	ep, _, err := GetRemoteEntrypoint(entrypointCache, digest)
+	if err != nil {
+		t.Fatalf("couldn't get entrypoint from store: %v", err)
+	}
+	if !reflect.DeepEqual(ep, expectedEntrypoint) {
+		t.Errorf("entrypoints do not match: %s should be %s", ep, expectedEntrypoint)
+	}
+}
+
+func TestCacheUndecodableStoreValue(t *testing.T) {
+	expectedEntrypoint := []string{"/bin/expected", "entrypoint"}
+	img := getImage(t, &v1.ConfigFile{
+		Config: v1.Config{
+			Entrypoint: expectedEntrypoint,
+		},
+	})
+	server := newRegistryServer(t, "image", img)
+	defer server.Close()
+	digest := path.Join(strings.TrimPrefix(server.URL, "http://"), "image") + "@" + getDigestAsString(img)
+
+	store := mapStore{"entrypoint/" + digest: []byte(`["/bin/stale"]`)}
+	core, logs := observer.New(zap.InfoLevel)
+	cache, err := NewCache(WithStore(store), WithLogger(zap.New(core).Sugar()))
+	if err != nil {
+		t.Fatalf("couldn't create new cache: %v", err)
+	}
+	ep, _, err := GetRemoteEntrypoint(cache, digest)
+	if err != nil {
+		t.Fatalf("couldn't get entrypoint: %v", err)
+	}
+	if !reflect.DeepEqual(ep, expectedEntrypoint) {
+		t.Errorf("entrypoints do not match: %s should be %s", ep, expectedEntrypoint)
+	}
+	if logs.Len() != 1 {
+		t.Errorf("expected the undecodable value to be logged, got: %v", logs.All())
+	}
+	var cached entrypointEntry
+	if !cache.load("entrypoint/"+digest, &cached) || !reflect.DeepEqual(cached.Command, expectedEntrypoint) {
+		t.Errorf("expected the undecodable value to be overwritten, got %s", store["entrypoint/"+digest])
+	}
+}
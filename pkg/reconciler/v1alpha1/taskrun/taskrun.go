@@ -20,6 +20,7 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"sync"
 
 	"github.com/knative/build-pipeline/pkg/apis/pipeline"
 	"github.com/knative/build-pipeline/pkg/apis/pipeline/v1alpha1"
@@ -95,11 +96,32 @@ type Reconciler struct {
 	resourceLister    listers.PipelineResourceLister
 	tracker           tracker.Interface
 	configStore       configStore
+
+	// entrypointMu guards the caches used to look up the entrypoint of step
+	// images, which are kept across reconciles and recreated when the
+	// entrypoint configuration they were created with changes.
+	entrypointMu     sync.Mutex
+	entrypointConfig *config.Entrypoint
+	entrypointCache  *entrypoint.Cache
+	digestCache      *entrypoint.Cache
+	entrypointStore  entrypoint.Store
 }
 
 // Check that our Reconciler implements controller.Reconciler
 var _ controller.Reconciler = (*Reconciler)(nil)
 
+// ControllerOption configures the controller created by NewController.
+type ControllerOption func(*Reconciler)
+
+// WithEntrypointStore makes the controller keep the digests and entrypoints
+// of step images in store instead of in memory, for instance to share them
+// between the replicas of the controller.
+func WithEntrypointStore(store entrypoint.Store) ControllerOption {
+	return func(c *Reconciler) {
+		c.entrypointStore = store
+	}
+}
+
 // NewController creates a new Configuration controller
 func NewController(
 	opt reconciler.Options,
@@ -108,6 +130,7 @@ func NewController(
 	clusterTaskInformer informers.ClusterTaskInformer,
 	resourceInformer informers.PipelineResourceInformer,
 	podInformer coreinformers.PodInformer,
+	opts ...ControllerOption,
 ) *controller.Impl {
 
 	c := &Reconciler{
@@ -117,6 +140,9 @@ func NewController(
 		clusterTaskLister: clusterTaskInformer.Lister(),
 		resourceLister:    resourceInformer.Lister(),
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
 	impl := controller.NewImpl(c, c.Logger, taskRunControllerName, reconciler.MustNewStatsReporter(taskRunControllerName, c.Logger))
 
 	c.Logger.Info("Setting up event handlers")
@@ -376,6 +402,41 @@ func createPVC(kc kubernetes.Interface, tr *v1alpha1.TaskRun) (*corev1.Persisten
 	return v, nil
 }
 
+// getEntrypointCaches returns the caches used to look up the entrypoint and
+// the digest of step images. They are created from the entrypoint
+// configuration in ctx the first time, and again whenever it changes.
+func (c *Reconciler) getEntrypointCaches(ctx context.Context) (*entrypoint.Cache, *entrypoint.Cache, error) {
+	cfg := config.FromContext(ctx).Entrypoint
+
+	c.entrypointMu.Lock()
+	defer c.entrypointMu.Unlock()
+	if c.entrypointCache != nil && reflect.DeepEqual(cfg, c.entrypointConfig) {
+		return c.entrypointCache, c.digestCache, nil
+	}
+	opts := []entrypoint.CacheOption{
+		entrypoint.WithRegistryMirrors(cfg.RegistryMirrors),
+		entrypoint.WithDockerConfig(cfg.DockerConfig),
+		entrypoint.WithLogger(c.Logger),
+	}
+	if cfg.UserAgent != "" {
+		opts = append(opts, entrypoint.WithUserAgent(cfg.UserAgent))
+	}
+	if c.entrypointStore != nil {
+		opts = append(opts, entrypoint.WithStore(c.entrypointStore))
+	}
+	entrypointCache, err := entrypoint.NewCache(opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't create new entrypoint cache: %v", err)
+	}
+	digestCache, err := entrypoint.NewCache(opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't create new digest cache: %v", err)
+	}
+	c.entrypointConfig = cfg
+	c.entrypointCache, c.digestCache = entrypointCache, digestCache
+	return entrypointCache, digestCache, nil
+}
+
 // createPod creates a Pod based on the Task's configuration, with pvcName as a
 // volumeMount
 func (c *Reconciler) createBuildPod(ctx context.Context, tr *v1alpha1.TaskRun, ts *v1alpha1.TaskSpec, taskName, pvcName string) (*corev1.Pod, error) {
@@ -387,13 +448,21 @@ func (c *Reconciler) createBuildPod(ctx context.Context, tr *v1alpha1.TaskRun, t
 
 	// For each step with no entrypoint set, try to populate it with the info
 	// from the remote registry
-	entrypointCache, err := entrypoint.NewCache()
+	entrypointCache, digestCache, err := c.getEntrypointCaches(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't create new entrypoint cache: %v", err)
+		return nil, err
 	}
-	digestCache, err := entrypoint.NewCache()
-	if err != nil {
-		return nil, fmt.Errorf("couldn't create new digest cache: %v", err)
+	var images []string
+	for _, step := range bs.Steps {
+		if len(step.Command) == 0 {
+			images = append(images, step.Image)
+		}
+	}
+	// Look up the images of all the steps at once, so that the lookups below
+	// are served from the caches. This is best effort: the lookups below
+	// report the images that couldn't be found.
+	if err := entrypoint.Warm(ctx, entrypointCache, digestCache, images); err != nil {
+		c.Logger.Warnf("Failed to warm the entrypoint caches for taskrun %s: %v", tr.Name, err)
 	}
 	bSpec := bs.DeepCopy()
 	for i := range bSpec.Steps {
@@ -403,10 +472,20 @@ func (c *Reconciler) createBuildPod(ctx context.Context, tr *v1alpha1.TaskRun, t
 			if err != nil {
 				return nil, fmt.Errorf("could not get digest for %s: %v", step.Image, err)
 			}
-			ep, err := entrypoint.GetRemoteEntrypoint(entrypointCache, digest)
+			// Run the image the entrypoint is looked up from, even if the
+			// tag has moved since its digest was cached.
+			step.Image = digest
+			ep, source, err := entrypoint.GetRemoteEntrypoint(entrypointCache, digest)
 			if err != nil {
-				return nil, fmt.Errorf("could not get entrypoint from registry for %s: %v", step.Image, err)
+				return nil, fmt.Errorf("could not get entrypoint from registry for %s: %v", bs.Steps[i].Image, err)
+			}
+			if source == entrypoint.SourceCmd && len(step.Args) > 0 {
+				// The args of the step replace the cmd of the image, and
+				// the image has no entrypoint to run them with.
+				c.Logger.Debugf("Using the args of step %q as its command instead of the Cmd of image %s", step.Name, digest)
+				continue
 			}
+			c.Logger.Debugf("Using the %s of image %s as the command of step %q", source, digest, step.Name)
 			step.Command = ep
 		}
 	}
@@ -15,8 +15,13 @@ package taskrun
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -25,6 +30,7 @@ import (
 	"github.com/knative/build-pipeline/pkg/apis/pipeline/v1alpha1"
 	"github.com/knative/build-pipeline/pkg/reconciler"
 	"github.com/knative/build-pipeline/pkg/reconciler/v1alpha1/taskrun/config"
+	"github.com/knative/build-pipeline/pkg/reconciler/v1alpha1/taskrun/entrypoint"
 	"github.com/knative/build-pipeline/pkg/reconciler/v1alpha1/taskrun/resources"
 	"github.com/knative/build-pipeline/pkg/system"
 	"github.com/knative/build-pipeline/test"
@@ -147,7 +153,7 @@ func getRunName(tr *v1alpha1.TaskRun) string {
 
 // getTaskRunController returns an instance of the TaskRun controller/reconciler that has been seeded with
 // d, where d represents the state of the system (existing resources) needed for the test.
-func getTaskRunController(d test.Data) test.TestAssets {
+func getTaskRunController(d test.Data, opts ...ControllerOption) test.TestAssets {
 	c, i := test.SeedTestData(d)
 	observer, logs := observer.New(zap.InfoLevel)
 	configMapWatcher := configmap.NewInformedWatcher(c.Kube, system.Namespace)
@@ -164,6 +170,7 @@ func getTaskRunController(d test.Data) test.TestAssets {
 			i.ClusterTask,
 			i.PipelineResource,
 			i.Pod,
+			opts...,
 		),
 		Logs:      logs,
 		Clients:   c,
@@ -410,6 +417,262 @@ func TestReconcile(t *testing.T) {
 	}
 }
 
+// fakeRegistry is a registry serving the repository "image". Everything
+// else it doesn't have.
+type fakeRegistry struct {
+	*httptest.Server
+	// requests is the number of requests the registry has received.
+	requests int32
+
+	mu        sync.Mutex
+	latest    string            // the manifest digest the latest tag points at
+	manifests map[string]string // by digest
+	blobs     map[string]string // by digest
+}
+
+// newFakeRegistry returns a registry serving an image with the given config
+// file as the latest tag of the repository "image".
+func newFakeRegistry(t *testing.T, config string) *fakeRegistry {
+	r := &fakeRegistry{
+		manifests: map[string]string{},
+		blobs:     map[string]string{},
+	}
+	r.push(config)
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&r.requests, 1)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if req.URL.Path == "/v2/" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if blob, ok := r.blobs[strings.TrimPrefix(req.URL.Path, "/v2/image/blobs/")]; ok {
+			w.Write([]byte(blob))
+			return
+		}
+		ref := strings.TrimPrefix(req.URL.Path, "/v2/image/manifests/")
+		if ref == "latest" {
+			ref = r.latest
+		}
+		if manifest, ok := r.manifests[ref]; ok {
+			w.Write([]byte(manifest))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`))
+	}))
+	return r
+}
+
+// push adds an image with the given config file to the registry, moves the
+// latest tag to it and returns its manifest digest.
+func (r *fakeRegistry) push(config string) string {
+	configDigest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(config)))
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json",`+
+		`"config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":%d,"digest":%q},"layers":[]}`,
+		len(config), configDigest)
+	manifestDigest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(manifest)))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blobs[configDigest] = config
+	r.manifests[manifestDigest] = manifest
+	r.latest = manifestDigest
+	return manifestDigest
+}
+
+// image returns the reference of the repository "image" in the registry.
+func (r *fakeRegistry) image() string {
+	return strings.TrimPrefix(r.URL, "http://") + "/image"
+}
+
+// reconcileBuildPod reconciles tr with c and returns its build pod.
+func reconcileBuildPod(t *testing.T, c test.TestAssets, tr *v1alpha1.TaskRun) *corev1.Pod {
+	t.Helper()
+	if err := c.Controller.Reconciler.Reconcile(context.Background(), getRunName(tr)); err != nil {
+		t.Fatalf("expected no error reconciling %s, got: %v", tr.Name, err)
+	}
+	reconciled, err := c.Clients.Pipeline.PipelineV1alpha1().TaskRuns(tr.Namespace).Get(tr.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting updated taskrun: %v", err)
+	}
+	if reconciled.Status.PodName == "" {
+		t.Fatalf("Reconcile didn't set pod name, status: %v", reconciled.Status.GetCondition(duckv1alpha1.ConditionSucceeded))
+	}
+	pod, err := c.Clients.Kube.CoreV1().Pods(tr.Namespace).Get(reconciled.Status.PodName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to fetch build pod: %v", err)
+	}
+	return pod
+}
+
+func TestReconcileStepsWithoutCommand(t *testing.T) {
+	registry := newFakeRegistry(t, `{"config":{"Cmd":["/bin/cmd","cmd-arg"]}}`)
+	defer registry.Close()
+	image := registry.image()
+
+	task := tb.Task("cmd-task", "foo", tb.TaskSpec(
+		tb.Step("no-args", image),
+		tb.Step("with-args", image, tb.Args("/bin/other", "other-arg")),
+	))
+	taskRun := tb.TaskRun("cmd-taskrun", "foo", tb.TaskRunSpec(tb.TaskRunTaskRef(task.Name)))
+	testAssets := getTaskRunController(test.Data{
+		TaskRuns: []*v1alpha1.TaskRun{taskRun},
+		Tasks:    []*v1alpha1.Task{task},
+	})
+	testAssets.Clients.Kube.CoreV1().ServiceAccounts("foo").Create(&corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "foo"},
+	})
+
+	pod := reconcileBuildPod(t, testAssets, taskRun)
+	// The args of a step replace the cmd of its image.
+	want := map[string]string{
+		"build-step-no-args":   `{"args":["/bin/cmd","cmd-arg"],"process_log":"/tools/process-log.txt","marker_file":"/tools/marker-file.txt"}`,
+		"build-step-with-args": `{"args":["/bin/other","other-arg"],"process_log":"/tools/process-log.txt","marker_file":"/tools/marker-file.txt"}`,
+	}
+	for _, c := range pod.Spec.InitContainers {
+		w, ok := want[c.Name]
+		if !ok {
+			continue
+		}
+		delete(want, c.Name)
+		var got string
+		for _, e := range c.Env {
+			if e.Name == "ENTRYPOINT_OPTIONS" {
+				got = e.Value
+			}
+		}
+		if got != w {
+			t.Errorf("entrypoint options of %s: got %s, want %s", c.Name, got, w)
+		}
+	}
+	for name := range want {
+		t.Errorf("build pod has no container %s", name)
+	}
+}
+
+func TestReconcileMissingImageNegativeCache(t *testing.T) {
+	registry := newFakeRegistry(t, `{"config":{"Entrypoint":["/bin/entrypoint"]}}`)
+	defer registry.Close()
+	image := registry.image() + ":deleted"
+
+	task := tb.Task("missing-image-task", "foo", tb.TaskSpec(tb.Step("step", image)))
+	first := tb.TaskRun("first-taskrun", "foo", tb.TaskRunSpec(tb.TaskRunTaskRef(task.Name)))
+	second := tb.TaskRun("second-taskrun", "foo", tb.TaskRunSpec(tb.TaskRunTaskRef(task.Name)))
+	testAssets := getTaskRunController(test.Data{
+		TaskRuns: []*v1alpha1.TaskRun{first, second},
+		Tasks:    []*v1alpha1.Task{task},
+	})
+
+	for i, tr := range []*v1alpha1.TaskRun{first, second} {
+		if err := testAssets.Controller.Reconciler.Reconcile(context.Background(), getRunName(tr)); err != nil {
+			t.Fatalf("expected no error reconciling %s, got: %v", tr.Name, err)
+		}
+		reconciled, err := testAssets.Clients.Pipeline.PipelineV1alpha1().TaskRuns(tr.Namespace).Get(tr.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("getting updated taskrun: %v", err)
+		}
+		condition := reconciled.Status.GetCondition(duckv1alpha1.ConditionSucceeded)
+		if condition == nil || condition.Status != corev1.ConditionFalse {
+			t.Errorf("expected %s with a missing image to fail, but had %v", tr.Name, condition)
+		}
+		if condition != nil && !strings.Contains(condition.Message, "could not get digest for "+image) {
+			t.Errorf("expected %s to fail on the digest of %s, but had %q", tr.Name, image, condition.Message)
+		}
+		got := atomic.LoadInt32(&registry.requests)
+		if i == 0 && got == 0 {
+			t.Fatalf("expected %s to look up the image in the registry", tr.Name)
+		}
+		if i == 1 && got != 0 {
+			t.Errorf("expected %s to not hit the registry, got %d requests", tr.Name, got)
+		}
+		atomic.StoreInt32(&registry.requests, 0)
+	}
+}
+
+func TestReconcileWithEntrypointStore(t *testing.T) {
+	registry := newFakeRegistry(t, `{"config":{"Entrypoint":["/bin/entrypoint"]}}`)
+	defer registry.Close()
+	image := registry.image()
+
+	task := tb.Task("store-task", "foo", tb.TaskSpec(tb.Step("step", image)))
+	taskRun := tb.TaskRun("store-taskrun", "foo", tb.TaskRunSpec(tb.TaskRunTaskRef(task.Name)))
+	store, err := entrypoint.NewMemoryStore(10)
+	if err != nil {
+		t.Fatalf("couldn't create new store: %v", err)
+	}
+
+	// The second controller, standing in for another replica, finds the
+	// image in the store the first one filled.
+	for i := 0; i < 2; i++ {
+		testAssets := getTaskRunController(test.Data{
+			TaskRuns: []*v1alpha1.TaskRun{taskRun.DeepCopy()},
+			Tasks:    []*v1alpha1.Task{task},
+		}, WithEntrypointStore(store))
+		testAssets.Clients.Kube.CoreV1().ServiceAccounts("foo").Create(&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "foo"},
+		})
+		reconcileBuildPod(t, testAssets, taskRun)
+		if i == 1 && atomic.LoadInt32(&registry.requests) != 0 {
+			t.Errorf("expected the second controller to not hit the registry, got %d requests", atomic.LoadInt32(&registry.requests))
+		}
+		atomic.StoreInt32(&registry.requests, 0)
+	}
+}
+
+func TestReconcileTagMovedBetweenReconciles(t *testing.T) {
+	registry := newFakeRegistry(t, `{"config":{"Entrypoint":["/bin/old"]}}`)
+	defer registry.Close()
+	image := registry.image()
+	oldDigest := registry.latest
+
+	task := tb.Task("moved-tag-task", "foo", tb.TaskSpec(tb.Step("step", image)))
+	first := tb.TaskRun("first-taskrun", "foo", tb.TaskRunSpec(tb.TaskRunTaskRef(task.Name)))
+	second := tb.TaskRun("second-taskrun", "foo", tb.TaskRunSpec(tb.TaskRunTaskRef(task.Name)))
+	testAssets := getTaskRunController(test.Data{
+		TaskRuns: []*v1alpha1.TaskRun{first, second},
+		Tasks:    []*v1alpha1.Task{task},
+	})
+	testAssets.Clients.Kube.CoreV1().ServiceAccounts("foo").Create(&corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "foo"},
+	})
+
+	firstPod := reconcileBuildPod(t, testAssets, first)
+	newDigest := registry.push(`{"config":{"Entrypoint":["/bin/new"]}}`)
+	secondPod := reconcileBuildPod(t, testAssets, second)
+
+	// Whichever image the tag resolves to, the step runs that image with its
+	// own entrypoint.
+	want := map[string]string{
+		image + "@" + oldDigest: `{"args":["/bin/old"],"process_log":"/tools/process-log.txt","marker_file":"/tools/marker-file.txt"}`,
+		image + "@" + newDigest: `{"args":["/bin/new"],"process_log":"/tools/process-log.txt","marker_file":"/tools/marker-file.txt"}`,
+	}
+	for _, pod := range []*corev1.Pod{firstPod, secondPod} {
+		var step *corev1.Container
+		for i := range pod.Spec.InitContainers {
+			if pod.Spec.InitContainers[i].Name == "build-step-step" {
+				step = &pod.Spec.InitContainers[i]
+			}
+		}
+		if step == nil {
+			t.Fatalf("build pod %s has no container build-step-step", pod.Name)
+		}
+		w, ok := want[step.Image]
+		if !ok {
+			t.Fatalf("expected the image of pod %s to be pinned to a digest of %s, got %s", pod.Name, image, step.Image)
+		}
+		var got string
+		for _, e := range step.Env {
+			if e.Name == "ENTRYPOINT_OPTIONS" {
+				got = e.Value
+			}
+		}
+		if got != w {
+			t.Errorf("entrypoint options of pod %s running %s: got %s, want %s", pod.Name, step.Image, got, w)
+		}
+	}
+}
+
 func TestReconcile_InvalidTaskRuns(t *testing.T) {
 	noTaskRun := tb.TaskRun("notaskrun", "foo", tb.TaskRunSpec(tb.TaskRunTaskRef("notask")))
 	withWrongRef := tb.TaskRun("taskrun-with-wrong-ref", "foo", tb.TaskRunSpec(